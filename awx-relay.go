@@ -1,16 +1,39 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
-	"strings"
+	"strconv"
+	"time"
 
+	"github.com/gin-contrib/sse"
 	"github.com/gin-gonic/gin"
 )
 
 type RelayCommand struct {
-	Port  string `short:"p" long:"port" description:"Port for the webserver to listen on" default:"8080"`
-	Debug bool   `short:"d" long:"debug" description:"Enables Gin debug mode"`
+	Port        string        `short:"p" long:"port" description:"Port for the webserver to listen on" default:"8080"`
+	Debug       bool          `short:"d" long:"debug" description:"Enables Gin debug mode"`
+	Inventories string        `short:"i" long:"inventories" description:"File mapping host types, distros and releases to AWX inventories" default:"/etc/awxclient/inventories.json"`
+	Keys        string        `short:"k" long:"keys" description:"File of keyid=secret lines, requests from hosts have to be signed with one of these keys" default:"/etc/awxclient/relay.keys"`
+	StateDir    string        `short:"s" long:"statedir" description:"Directory the state of each build is kept in, builds that were interrupted are resumed on startup" default:"/var/lib/awxclient"`
+	Cert        string        `long:"cert" description:"Certificate of the relay, the relay serves HTTPS when it's set"`
+	CertKey     string        `long:"certkey" description:"Private key of the certificate of the relay"`
+	ClientCA    string        `long:"clientca" description:"CA certificate(s) client certificates are verified against, hosts have to present a certificate when it's set"`
+	Clients     string        `long:"clients" description:"File mapping CN/SAN patterns of client certificates to the facilities they can build hosts in, requires --clientca"`
+	LogDir      string        `long:"logdir" description:"Directory the log of each build is written to" default:"/var/log/awx-relay"`
+	LogMaxAge   time.Duration `long:"logmaxage" description:"Build logs older than this are removed, 0 keeps them forever" default:"720h"`
+	LogMaxSize  int64         `long:"logmaxsize" description:"The oldest build logs are removed once all of them take up more MB than this, 0 for no limit" default:"1024"`
+	MetricsPort string        `long:"metricsport" description:"Serve /metrics, /healthz and /readyz over plain HTTP on this port instead of the port of the relay, required to reach them on a relay started with --clientca"`
+	MetricsStep []string      `long:"metricsstep" description:"Name of a step of the awxvars pipelines which gets its own label in the step metrics, can be repeated. Every other step is counted as other" default:"breakglass" default:"baseline"`
+
+	AwxOptions `group:"AWX Options"`
+	LogOptions `group:"Logging Options"`
+
+	inventories *InventoryMap
+	awxConfig   AwxConfig
+	logs        *BuildLogs
 }
 
 var relayCommand RelayCommand
@@ -22,115 +45,403 @@ func init() {
 // HostData is the data received from a midtier host
 type HostData struct {
 	Fqdn           string `json:"fqdn" binding:"required"`
-	BreakglassID   int    `json:"breakglassid" binding:"required"`
-	BreakglassName string `json:"breakglassname" binding:"required"`
-	BaselineID     int    `json:"baselineid" binding:"required"`
-	BaselineName   string `json:"baselinename" binding:"required"`
-	InvID          int    `json:"invid" binding:"required"`
+	Steps          []Step `json:"steps" binding:"required"`
 	InvName        string `json:"invname" binding:"required"`
 	DesiredRelease string `json:"desiredrelease" required:"true"`
 	Reboot         string `json:"reboot" required:"true"`
 	Type           string `json:"type"`
 	Facility       string `json:"facility"`
+	Distro         string `json:"distro"`
 	Mock           string `json:"mock"`
 }
 
 // sets up API endpoints and their related functions
 func (r *RelayCommand) Execute(args []string) error {
+	if err := r.LogOptions.Setup(); err != nil {
+		return fmt.Errorf("relay: %w", err)
+	}
+
+	// refuse to start with a broken mapping rather than failing every build later on
+	var err error
+	if r.inventories, err = LoadInventoryMap(r.Inventories); err != nil {
+		return fmt.Errorf("relay: %w", err)
+	}
+
+	if r.awxConfig, err = r.AwxOptions.Load(true); err != nil {
+		return fmt.Errorf("relay: %w", err)
+	}
+
+	// the relay talks to AWX with its own credentials, the hosts it builds never have any
+	if _, err := r.awxConfig.Credentials.Credentials(); err != nil {
+		return fmt.Errorf("relay: can't read the AWX credentials of the relay: %w", err)
+	}
+
+	// every request has to be signed, so nobody else on the network can launch AWX jobs through the relay
+	keys, err := LoadRelayKeys(r.Keys)
+	if err != nil {
+		return fmt.Errorf("relay: %w", err)
+	}
+
+	if (r.Cert == "") != (r.CertKey == "") {
+		return fmt.Errorf("relay: --cert and --certkey have to be set together")
+	}
+	if r.ClientCA != "" && r.Cert == "" {
+		return fmt.Errorf("relay: --clientca requires --cert and --certkey, client certificates can only be verified over HTTPS")
+	}
+	if r.Clients != "" && r.ClientCA == "" {
+		return fmt.Errorf("relay: --clients requires --clientca")
+	}
+
+	var clients *ClientRules
+	if r.Clients != "" {
+		if clients, err = LoadClientRules(r.Clients); err != nil {
+			return fmt.Errorf("relay: %w", err)
+		}
+	}
+
+	SetMetricsSteps(r.MetricsStep)
+
+	// every build gets its own log, old ones are removed in the background
+	r.logs = &BuildLogs{Dir: r.LogDir, MaxAge: r.LogMaxAge, MaxSize: r.LogMaxSize * 1024 * 1024}
+	go r.logs.PruneEvery(buildLogPruneInterval)
+
+	// pick up the builds that were running when the relay was stopped
+	if err := r.resumeBuilds(); err != nil {
+		return fmt.Errorf("relay: %w", err)
+	}
+
 	if !r.Debug {
 		gin.SetMode(gin.ReleaseMode)
 	}
 
-	//create our instance
-	router := gin.Default()
+	router := relayRouter(keys, clients)
 
-	//disable proxy handling, it complains if you trust all which is set by default
-	router.SetTrustedProxies(nil)
-
-	//create enpoint to build a host
-	router.POST("/build/", build)
+	// Prometheus, systemd and the load balancer can't sign their requests, or present a
+	// client certificate, so /metrics, /healthz and /readyz can get their own port
+	public := router
+	if r.MetricsPort != "" {
+		public = gin.New()
+	}
+	ready := &readiness{relay: r}
+	public.GET("/metrics", MetricsHandler())
+	public.GET("/healthz", healthz)
+	public.GET("/readyz", ready.readyz)
+	if r.MetricsPort != "" {
+		go func() {
+			if err := public.Run(fmt.Sprintf("0.0.0.0:%v", r.MetricsPort)); err != nil {
+				logger.Errorf("can't serve /metrics, /healthz and /readyz on port %v: %v", r.MetricsPort, err)
+			}
+		}()
+	}
 
 	//set the IP and port to listen on
 	ipPort := fmt.Sprintf("0.0.0.0:%v", r.Port)
 
 	//start the webserver
-	if err := router.Run(ipPort); err != nil {
-		return fmt.Errorf("startWebserver(): router.Run(): %w", err)
-	} else {
-		fmt.Printf("Started AWX-Relay webserver on port %v", r.Port)
+	if r.Cert == "" {
+		if err := router.Run(ipPort); err != nil {
+			return fmt.Errorf("startWebserver(): router.Run(): %w", err)
+		}
+		return nil
+	}
+
+	tlsConfig, err := RelayServerTLS(r.ClientCA)
+	if err != nil {
+		return fmt.Errorf("relay: %w", err)
+	}
+
+	server := &http.Server{Addr: ipPort, Handler: router, TLSConfig: tlsConfig}
+	logger.Infof("Starting AWX-Relay webserver with HTTPS on port %v", r.Port)
+	if err := server.ListenAndServeTLS(r.Cert, r.CertKey); err != nil {
+		return fmt.Errorf("startWebserver(): server.ListenAndServeTLS(): %w", err)
 	}
 
 	return nil
 }
 
-// ReadMidtierFqdn is a quick hack for fixing the logging of 'relay' mode, otherwise all
-// PrintStatus() calls would need to accept 'fqdn' as a parameter when run in 'relay' mode
-// but this isnt't needed in midtier or internal mode since it logs to the host it's run on
-func ReadMidtierFqdn() string {
-	return fqdn
+// relayRouter creates the webserver along with the endpoints used by the hosts being built
+func relayRouter(keys RelayKeys, clients *ClientRules) *gin.Engine {
+	//create our instance
+	router := gin.Default()
+
+	//disable proxy handling, it complains if you trust all which is set by default
+	router.SetTrustedProxies(nil)
+
+	// only the hosts being built have to sign their requests
+	signed := router.Group("/build")
+	if clients != nil {
+		signed.Use(RequireClientCert(clients))
+	}
+	signed.Use(RequireSignature(keys))
+
+	//create enpoint to build a host
+	signed.POST("/", build)
+
+	//create endpoint for the host to poll the status of its build
+	signed.GET("/:id", buildStatus)
+
+	// streams the log of a build as it happens
+	signed.GET("/:id/events", buildEvents)
+
+	// cancels a build along with the AWX job it's waiting on
+	signed.DELETE("/:id", cancelBuild)
+
+	return router
 }
 
+// build accepts the data sent by a host and starts its build in the background, the
+// host is given a build ID straight away which it uses to poll GET /build/{id}
 func build(c *gin.Context) {
 	var input HostData
 
-	// tells PrintStatus() where to log output, for the relay all output related
-	// to the host being built is written to /var/log/awx-relay/[fqdn].log
-	relay = true
-
 	//binding our received data (c) with a struct (input)
 	//verifying the JSON in the process
 	if err := c.ShouldBindJSON(&input); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"build(): c.ShouldBindJSON(): ": err.Error()})
+		abortWithError(c, NewError(ErrConfig, "the build request is invalid: %v", err),
+			"Ensure awxclient on the host is the same version as on the relay.")
+		return
+	}
+
+	if err := ValidateSteps(input.Steps); err != nil {
+		abortWithError(c, NewError(ErrConfig, "the steps of the build are invalid: %v", err),
+			"Fix the steps in the awxvars file.")
+		return
+	}
+
+	// the FQDN names the state and log files of the host
+	if err := ValidateFQDN(input.Fqdn); err != nil {
+		abortWithError(c, err, "Ensure the hostname of the host is its FQDN.")
+		return
+	}
+
+	if !facilityAllowed(c, input.Facility) {
+		abortWithError(c, NewError(ErrForbidden, "the certificate of the host isn't allowed to build hosts in facility %q", input.Facility),
+			"Ensure the host was issued a certificate for its facility, or add the facility to the client certificate rules of the relay.")
 		return
 	}
 
 	jobVars := JobVars{
-		BreakglassID:   input.BreakglassID,
-		BreakglassName: input.BreakglassName,
-		BaselineID:     input.BaselineID,
-		BaselineName:   input.BaselineName,
-		InvID:          input.InvID,
+		Steps:          input.Steps,
 		InvName:        input.InvName,
 		DesiredRelease: input.DesiredRelease,
 		Reboot:         input.Reboot,
 		FQDN:           input.Fqdn,
 		Type:           input.Type,
 		Facility:       input.Facility,
+		Distro:         input.Distro,
 		Mock:           input.Mock,
 	}
 
-	// quick hack for PrintStatus()
-	fqdn = jobVars.FQDN
+	// a failed build keeps the steps that completed, so they aren't launched again when the host retries
+	state, err := LoadBuildState(relayCommand.StateDir, jobVars.FQDN)
+	if err != nil {
+		abortWithError(c, fmt.Errorf("build(): %w", err), pteRemediation)
+		return
+	}
 
-	fmt.Printf("INFO: Launching AWX jobs for %v...\n", input.Fqdn)
-	fmt.Printf("INFO: See /var/log/awx-relay/%v.log for more info\n", jobVars.FQDN)
+	newBuild, running, err := builds.New(jobVars.FQDN, jobVars.Facility, state.BuildID)
+	if err != nil {
+		abortWithError(c, fmt.Errorf("build(): %w", err), pteRemediation)
+		return
+	}
 
-	// kick off breakglass, wait until it finishes, and then kick off baseline
-	status, jobErr := KickoffJobs(input.Fqdn, jobVars, jobVars.Mock)
-	PrintStatus("INFO: Sending the build status to the host...")
+	// the host was rebooted or lost track of its build, hand it the one that's already running
+	if running {
+		logger.Log(LevelInfo, "the host already has a build running", LogFields{FQDN: input.Fqdn, BuildID: newBuild.Status().ID})
+		c.JSON(http.StatusAccepted, newBuild.Status())
+		return
+	}
+
+	fields := LogFields{FQDN: input.Fqdn, BuildID: newBuild.Status().ID}
+	if err := state.SetBuildID(newBuild.Status().ID); err != nil {
+		logger.Log(LevelError, fmt.Sprintf("couldn't save the build state: %v", err), fields)
+	}
+	if err := state.SetJobVars(jobVars); err != nil {
+		logger.Log(LevelError, fmt.Sprintf("couldn't save the build state: %v", err), fields)
+	}
+
+	startBuild(newBuild, state, jobVars)
+
+	c.JSON(http.StatusAccepted, newBuild.Status())
+}
+
+// resumeBuilds restarts the builds which were interrupted, the AWX jobs they were
+// waiting on are reattached to rather than launched again
+func (r *RelayCommand) resumeBuilds() error {
+	states, err := ListBuildStates(r.StateDir)
+	if err != nil {
+		return fmt.Errorf("resumeBuilds(): %w", err)
+	}
+
+	for _, state := range states {
+		b, _, err := builds.New(state.FQDN, state.JobVars.Facility, state.BuildID)
+		if err != nil {
+			return fmt.Errorf("resumeBuilds(): %w", err)
+		}
+
+		logger.Log(LevelInfo, "Resuming build", LogFields{FQDN: state.FQDN, BuildID: state.BuildID})
+		startBuild(b, state, state.JobVars)
+	}
+
+	return nil
+}
+
+// startBuild runs a build in the background
+func startBuild(b *Build, state *BuildState, jobVars JobVars) {
+	fields := LogFields{FQDN: jobVars.FQDN, Facility: jobVars.Facility, Type: jobVars.Type, BuildID: b.Status().ID}
+
+	// for the relay all output related to the host being built is also written to /var/log/awx-relay/[fqdn]/[timestamp]-[build ID].log
+	buildLog, err := relayCommand.logs.Open(jobVars.FQDN, b.Status().ID)
+	if err != nil {
+		logger.Log(LevelError, fmt.Sprintf("can't open the build log, only logging to STDOUT: %v", err), fields)
+	} else {
+		logger.Log(LevelInfo, fmt.Sprintf("Launching AWX jobs, see %v for more info", buildLog.Path()), fields)
+	}
+
+	bc := &BuildContext{
+		FQDN:        jobVars.FQDN,
+		JobVars:     jobVars,
+		AwxConfig:   relayCommand.awxConfig,
+		Inventories: relayCommand.inventories,
+		Log:         buildLog,
+		State:       state,
+		Build:       b,
+	}
+
+	buildStarted(jobVars)
+	go runBuild(bc)
+}
+
+// buildStatus returns the current phase, AWX job ID and result of a build
+func buildStatus(c *gin.Context) {
+	b := builds.Get(c.Param("id"))
+	if b == nil {
+		abortWithError(c, NewError(ErrNotFound, "build %v doesn't exist", c.Param("id")),
+			"The relay may have been restarted after the build finished, run awxclient foreman again.")
+		return
+	}
+
+	if !facilityAllowed(c, b.Facility()) {
+		abortWithError(c, NewError(ErrForbidden, "the certificate of the host isn't allowed to see builds in facility %q", b.Facility()),
+			"Check the build from the host being built, or from a host allowed to build hosts in its facility.")
+		return
+	}
+
+	c.JSON(http.StatusOK, b.Status())
+}
+
+// cancelBuild stops a build which is still running. The build finishes as cancelled once the AWX
+// job it was waiting on is cancelled, cancelling a build that already finished does nothing
+func cancelBuild(c *gin.Context) {
+	b := builds.Get(c.Param("id"))
+	if b == nil {
+		abortWithError(c, NewError(ErrNotFound, "build %v doesn't exist", c.Param("id")),
+			"The relay may have been restarted after the build finished, there is nothing left to cancel.")
+		return
+	}
+
+	if !facilityAllowed(c, b.Facility()) {
+		abortWithError(c, NewError(ErrForbidden, "the certificate of the host isn't allowed to cancel builds in facility %q", b.Facility()),
+			"Cancel the build from the host being built, or from a host allowed to build hosts in its facility.")
+		return
+	}
+
+	if !b.Cancel() {
+		c.JSON(http.StatusOK, b.Status())
+		return
+	}
+
+	logger.Log(LevelInfo, fmt.Sprintf("Cancelling the build at the request of %v", c.ClientIP()), LogFields{FQDN: b.Status().FQDN, BuildID: b.Status().ID})
+	c.JSON(http.StatusAccepted, b.Status())
+}
+
+// how often an idle event stream sends a comment, so proxies don't close the connection
+const eventKeepAlive = 30 * time.Second
+
+// buildEvents streams the log and phase changes of a build as Server-Sent Events. The
+// events the relay still has are sent first, after the Last-Event-ID of a client that
+// reconnects, and the stream ends once the build has finished
+func buildEvents(c *gin.Context) {
+	b := builds.Get(c.Param("id"))
+	if b == nil {
+		abortWithError(c, NewError(ErrNotFound, "build %v doesn't exist", c.Param("id")),
+			"The relay may have been restarted after the build finished, run awxclient foreman again.")
+		return
+	}
+
+	if !facilityAllowed(c, b.Facility()) {
+		abortWithError(c, NewError(ErrForbidden, "the certificate of the host isn't allowed to see builds in facility %q", b.Facility()),
+			"Follow the build from the host being built, or from a host allowed to build hosts in its facility.")
+		return
+	}
+
+	after, _ := strconv.Atoi(c.GetHeader("Last-Event-ID"))
+	backlog, events, unsubscribe := b.Subscribe(after)
+	defer unsubscribe()
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	for _, event := range backlog {
+		renderEvent(c, event)
+	}
+	c.Writer.Flush()
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return false
+			}
+			renderEvent(c, event)
+			return true
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			return true
+		case <-c.Request.Context().Done():
+			return false
+		}
+	})
+}
+
+func renderEvent(c *gin.Context, event BuildEvent) {
+	c.Render(-1, sse.Event{Id: strconv.Itoa(event.ID), Event: event.Type, Data: event})
+}
+
+// runBuild kicks off the AWX jobs for a host and records the outcome in the build
+func runBuild(bc *BuildContext) {
+	b := bc.Build
+	started := time.Now()
+
+	// kick off each step, wait until it finishes, and then kick off the next one
+	status, jobErr := KickoffJobs(bc)
 	if jobErr != nil {
-		if strings.Contains(jobErr.Error(), "failed") {
-			c.JSON(http.StatusOK, jobErr.Error())
+		if errors.Is(jobErr, ErrCancelled) {
+			bc.PrintStatus("INFO: The build was cancelled")
+			b.Finish(ResultCancelled, BuildError(bc, jobErr))
+		} else if errors.Is(jobErr, ErrJobFailed) {
+			bc.PrintStatus("INFO: letting the client know that the job failed...")
+			b.Finish(ResultFailed, BuildError(bc, jobErr))
 		} else {
-			if strings.Contains(jobErr.Error(), "ERROR") {
-				PrintStatus("INFO: letting the client know that the job failed...")
-				c.JSON(http.StatusInternalServerError, jobErr.Error())
-				return
-			} else {
-				PrintStatus(fmt.Sprintf("ERROR: build(): %v", jobErr))
-				PrintStatus("INFO: letting the client know that the job failed...")
-				c.JSON(http.StatusInternalServerError, jobErr.Error())
-				return
-			}
+			bc.PrintStatus(fmt.Sprintf("ERROR: build(): %v", jobErr))
+			bc.PrintStatus("INFO: letting the client know that the job failed...")
+			b.Finish(ResultError, BuildError(bc, jobErr))
 		}
 	} else if status == "successful" {
-		PrintStatus(fmt.Sprintf("INFO: %v and %v were executed successfully", jobVars.BreakglassName, jobVars.BaselineName))
-		c.JSON(http.StatusOK, status)
-		return
+		bc.PrintStatus("INFO: All AWX jobs were executed successfully")
+		b.Finish(ResultSuccessful, nil)
 	} else {
-		PrintStatus(fmt.Sprintf("INFO: unknown job status %v", status))
-		c.JSON(http.StatusInternalServerError, status)
-		return
+		bc.PrintStatus(fmt.Sprintf("INFO: unknown job status %v", status))
+		b.Finish(ResultError, BuildError(bc, fmt.Errorf("unknown job status %v", status)))
 	}
 
+	bc.CheckState(bc.State.Finish(b.Status().Result))
+	buildFinished(bc.JobVars, b.Status().Result, started)
+
+	// the relay never runs CleanUp(), so the token created for this build is revoked here
+	if err := bc.AWX.RevokeToken(); err != nil {
+		bc.PrintStatus(fmt.Sprintf("ERROR: %v", err))
+	}
 }
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// fakeAwx is just enough of the AWX API to run a build with a single job step. Every job is
+// launched against the host in its limit and keeps running until release() or until it's cancelled
+type fakeAwx struct {
+	mu        sync.Mutex
+	jobs      map[int]string // the limit each job was launched with
+	cancelled map[int]bool   // the jobs cancelled through the API
+	released  bool
+
+	hang    string        // launch or job, that call never responds and is left for the relay to abandon
+	hanging chan struct{} // receives every call that hangs
+}
+
+func newFakeAwx(t *testing.T) (*fakeAwx, *httptest.Server) {
+	awx := &fakeAwx{jobs: make(map[int]string), cancelled: make(map[int]bool), hanging: make(chan struct{}, 10)}
+	server := httptest.NewServer(awx)
+	t.Cleanup(server.Close)
+	return awx, server
+}
+
+func (f *fakeAwx) release() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.released = true
+}
+
+// hangOn makes the launch of a job, or the status of a job, hang from now on
+func (f *fakeAwx) hangOn(call string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.hang = call
+}
+
+func (f *fakeAwx) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/") // api, v2, ...
+	if len(path) < 3 {
+		http.NotFound(w, r)
+		return
+	}
+
+	f.mu.Lock()
+	launch := len(path) == 5 && path[2] == "job_templates" && path[4] == "launch"
+	if (launch && f.hang == "launch") || (len(path) == 4 && path[2] == "jobs" && f.hang == "job") {
+		// AWX still launches the job, it just never says so
+		if launch {
+			f.launch(r)
+		}
+		f.mu.Unlock()
+
+		f.hanging <- struct{}{}
+		<-r.Context().Done()
+		return
+	}
+	defer f.mu.Unlock()
+
+	reply := func(status int, body interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(body)
+	}
+	list := func(results ...interface{}) map[string]interface{} {
+		return map[string]interface{}{"count": len(results), "results": results}
+	}
+
+	switch {
+	case path[2] == "inventories":
+		reply(http.StatusOK, list(map[string]interface{}{"id": 1, "name": "midtier"}))
+	case path[2] == "job_templates" && len(path) == 3:
+		reply(http.StatusOK, list(map[string]interface{}{"id": 7, "name": "baseline"}))
+	case launch:
+		id := f.launch(r)
+		reply(http.StatusCreated, map[string]interface{}{"job": id, "id": id})
+	case path[2] == "hosts":
+		name := r.URL.Query().Get("name")
+		reply(http.StatusOK, list(map[string]interface{}{"id": 1, "name": name, "inventory": 1}))
+	case path[2] == "jobs" && len(path) == 3:
+		var jobs []interface{}
+		for id, host := range f.jobs {
+			jobs = append(jobs, map[string]interface{}{"id": id, "name": "baseline", "status": f.status(id), "limit": host})
+		}
+		reply(http.StatusOK, list(jobs...))
+	case path[2] == "jobs" && len(path) >= 4:
+		id, _ := strconv.Atoi(path[3])
+		host, ok := f.jobs[id]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		switch {
+		case len(path) == 4:
+			reply(http.StatusOK, map[string]interface{}{"id": id, "name": "baseline", "status": f.status(id)})
+		case path[4] == "cancel":
+			f.cancelled[id] = true
+			reply(http.StatusAccepted, map[string]interface{}{})
+		case path[4] == "job_host_summaries":
+			reply(http.StatusOK, list(map[string]interface{}{"job": id, "host_name": host, "ok": 3}))
+		case path[4] == "job_events" && r.URL.Query().Get("counter__gt") == "0":
+			reply(http.StatusOK, list(map[string]interface{}{"counter": 1, "event": "runner_on_ok", "host_name": host, "stdout": "ok: [" + host + "]"}))
+		case path[4] == "job_events":
+			reply(http.StatusOK, list())
+		default:
+			http.NotFound(w, r)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// launch records a job launched against the limit of the request, f.mu has to be held
+func (f *fakeAwx) launch(r *http.Request) int {
+	var params struct {
+		Limit string `json:"limit"`
+	}
+	json.NewDecoder(r.Body).Decode(&params)
+	id := len(f.jobs) + 100
+	f.jobs[id] = params.Limit
+	return id
+}
+
+// status returns the status of a job, f.mu has to be held
+func (f *fakeAwx) status(id int) string {
+	switch {
+	case f.cancelled[id]:
+		return "canceled"
+	case f.released:
+		return "successful"
+	default:
+		return "running"
+	}
+}
+
+// setupRelay points the relay at the fake AWX and returns a signed test server of the relay along with its key
+func setupRelay(t *testing.T, awxURL string) (*httptest.Server, RelayKey) {
+	gin.SetMode(gin.TestMode)
+	gin.DefaultWriter = io.Discard
+	logger = NewLogger(io.Discard, LogFormatText, LevelError)
+
+	creds := filepath.Join(t.TempDir(), "creds")
+	if err := os.WriteFile(creds, []byte("user=relay\npass=secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	relayCommand.StateDir = t.TempDir()
+	relayCommand.logs = &BuildLogs{Dir: t.TempDir()}
+	relayCommand.awxConfig = AwxConfig{URL: awxURL, Credentials: &FileCredentials{Path: creds}}
+	relayCommand.inventories = &InventoryMap{Inventories: []InventoryMapping{{Type: "midtier", InventoryName: "midtier", Group: "{facility}"}}}
+
+	key := RelayKey{ID: "test", Secret: "c2VjcmV0=="}
+	server := httptest.NewServer(relayRouter(RelayKeys{key.ID: key.Secret}, nil))
+	t.Cleanup(server.Close)
+
+	return server, key
+}
+
+// postBuild sends a signed POST /build/ for fqdn and returns the build the relay started
+func postBuild(server *httptest.Server, key RelayKey, fqdn string) (BuildStatus, error) {
+	var status BuildStatus
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"fqdn":           fqdn,
+		"steps":          []Step{{Template: "baseline", Poll: PollPolicy{Delay: "0s", Interval: "20ms"}}},
+		"invname":        "midtier",
+		"desiredrelease": "8.6",
+		"reboot":         "false",
+		"type":           "midtier",
+		"facility":       "dc1",
+		"distro":         "rocky",
+	})
+
+	request, err := http.NewRequest(http.MethodPost, server.URL+"/build/", bytes.NewReader(body))
+	if err != nil {
+		return status, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if err := key.Sign(request, body); err != nil {
+		return status, err
+	}
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return status, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusAccepted {
+		respBody, _ := io.ReadAll(response.Body)
+		return status, fmt.Errorf("POST /build/ for %v responded with %v: %s", fqdn, response.Status, respBody)
+	}
+
+	return status, json.NewDecoder(response.Body).Decode(&status)
+}
+
+// TestConcurrentBuilds fires many builds at the relay at once, run it with -race
+func TestConcurrentBuilds(t *testing.T) {
+	awx, awxServer := newFakeAwx(t)
+	server, key := setupRelay(t, awxServer.URL)
+
+	const hosts, requestsPerHost = 24, 3
+
+	var mu sync.Mutex
+	buildIDs := make(map[string]map[string]bool) // FQDN -> the build IDs the relay handed out
+
+	var wg sync.WaitGroup
+	for i := 0; i < hosts; i++ {
+		fqdn := fmt.Sprintf("host%02d.dc1.example.com", i)
+		for j := 0; j < requestsPerHost; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				status, err := postBuild(server, key, fqdn)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				mu.Lock()
+				defer mu.Unlock()
+				if buildIDs[fqdn] == nil {
+					buildIDs[fqdn] = make(map[string]bool)
+				}
+				buildIDs[fqdn][status.ID] = true
+			}()
+		}
+	}
+	wg.Wait()
+	if t.Failed() {
+		t.FailNow()
+	}
+
+	// every request for a host is handed the same build, and no two hosts share one
+	owner := make(map[string]string)
+	for fqdn, ids := range buildIDs {
+		if len(ids) != 1 {
+			t.Errorf("%v was handed %v builds, expected one: %v", fqdn, len(ids), ids)
+		}
+		for id := range ids {
+			if other, ok := owner[id]; ok {
+				t.Errorf("%v and %v share build %v", fqdn, other, id)
+			}
+			owner[id] = fqdn
+		}
+	}
+
+	// the jobs are only let go once every request is in, so no build finished early
+	awx.release()
+
+	deadline := time.Now().Add(30 * time.Second)
+	for id, fqdn := range owner {
+		b := builds.Get(id)
+		for b.Status().Phase != PhaseFinished {
+			if time.Now().After(deadline) {
+				t.Fatalf("build %v of %v didn't finish, it's %v", id, fqdn, b.Status().Phase)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+
+		status := b.Status()
+		if status.FQDN != fqdn || status.Result != ResultSuccessful {
+			t.Errorf("build %v of %v finished as %v for %v: %+v", id, fqdn, status.Result, status.FQDN, status.Error)
+		}
+	}
+
+	// each build launched its job against its own host only
+	awx.mu.Lock()
+	launched := make(map[string]int)
+	for _, limit := range awx.jobs {
+		launched[limit]++
+	}
+	awx.mu.Unlock()
+	for fqdn := range buildIDs {
+		if launched[fqdn] != 1 {
+			t.Errorf("%v had %v jobs launched against it, expected one", fqdn, launched[fqdn])
+		}
+	}
+
+	// and the log of each build only holds the output of its own host
+	for id, fqdn := range owner {
+		logs, _ := filepath.Glob(filepath.Join(relayCommand.logs.Dir, fqdn, "*-"+id+".log"))
+		if len(logs) != 1 {
+			t.Errorf("expected one log for build %v of %v, found %v", id, fqdn, logs)
+			continue
+		}
+		data, err := os.ReadFile(logs[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(data), "ok: ["+fqdn+"]") {
+			t.Errorf("the log of %v is missing the output of its job:\n%s", fqdn, data)
+		}
+		for other := range buildIDs {
+			if other != fqdn && strings.Contains(string(data), other) {
+				t.Errorf("the log of %v mentions %v:\n%s", fqdn, other, data)
+			}
+		}
+	}
+}
+
+// TestCancelBuild cancels builds while a call to AWX is in flight, they have to finish as
+// cancelled rather than as an error, and the job they launched has to be cancelled in AWX
+func TestCancelBuild(t *testing.T) {
+	for i, call := range []string{"launch", "job"} {
+		fqdn := fmt.Sprintf("cancel%02d.dc1.example.com", i)
+		call := call
+		t.Run(call, func(t *testing.T) {
+			awx, awxServer := newFakeAwx(t)
+			server, key := setupRelay(t, awxServer.URL)
+			awx.hangOn(call)
+
+			status, err := postBuild(server, key, fqdn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case <-awx.hanging:
+			case <-time.After(10 * time.Second):
+				t.Fatalf("the build of %v never called AWX to %v", fqdn, call)
+			}
+
+			request, err := http.NewRequest(http.MethodDelete, server.URL+"/build/"+status.ID, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := key.Sign(request, nil); err != nil {
+				t.Fatal(err)
+			}
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			response.Body.Close()
+			if response.StatusCode != http.StatusAccepted {
+				t.Fatalf("DELETE /build/%v responded with %v", status.ID, response.Status)
+			}
+
+			b := builds.Get(status.ID)
+			deadline := time.Now().Add(10 * time.Second)
+			for b.Status().Phase != PhaseFinished {
+				if time.Now().After(deadline) {
+					t.Fatalf("the cancelled build of %v didn't finish, it's %v", fqdn, b.Status().Phase)
+				}
+				time.Sleep(20 * time.Millisecond)
+			}
+			if status := b.Status(); status.Result != ResultCancelled {
+				t.Errorf("the build of %v finished as %v, expected %v: %+v", fqdn, status.Result, ResultCancelled, status.Error)
+			}
+
+			awx.mu.Lock()
+			defer awx.mu.Unlock()
+			if len(awx.jobs) != 1 || len(awx.cancelled) != 1 {
+				t.Errorf("the build of %v launched jobs %v and cancelled %v, expected the one job it launched to be cancelled",
+					fqdn, awx.jobs, awx.cancelled)
+			}
+		})
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	awxGo "github.com/Colstuwjx/awx-go"
+)
+
+// AwxClient is the awx-go client along with what's needed to call the AWX API
+// endpoints that awx-go doesn't support, ex. workflow job templates
+type AwxClient struct {
+	*awxGo.AWX
+	baseURL  string
+	username string
+	password string
+	token    string    // OAuth2 token, used instead of basic auth when it's set
+	app      *oauthApp // the application the token was created with, if it was created by us
+	client   *http.Client
+}
+
+// NewAwxClient creates the awx-go client and keeps the settings around for raw API calls. The
+// calls awx-go makes are abandoned once ctx is done, awx-go doesn't take a context itself
+func NewAwxClient(ctx context.Context, baseURL, username, password string, client *http.Client) *AwxClient {
+	return &AwxClient{
+		AWX:      awxGo.NewAWX(baseURL, username, password, withContext(ctx, client)),
+		baseURL:  baseURL,
+		username: username,
+		password: password,
+		client:   client,
+	}
+}
+
+// NewAwxTokenClient creates the awx-go client authenticating with an OAuth2 token instead of a password
+func NewAwxTokenClient(ctx context.Context, baseURL, token string, client *http.Client) *AwxClient {
+	// awx-go only knows basic auth, so its requests get the token swapped in on the way out
+	tokenClient := *client
+	tokenClient.Transport = &bearerTransport{token: token, base: client.Transport}
+
+	return &AwxClient{
+		AWX:     awxGo.NewAWX(baseURL, "", "", withContext(ctx, &tokenClient)),
+		baseURL: baseURL,
+		token:   token,
+		client:  client,
+	}
+}
+
+// awxTransport turns failed requests to AWX into typed errors, for awx-go as well as the raw API calls
+type awxTransport struct {
+	base http.RoundTripper
+}
+
+func (t *awxTransport) RoundTrip(request *http.Request) (response *http.Response, err error) {
+	started := time.Now()
+	defer func() { observeAwxRequest(request, started, err) }()
+
+	response, err = t.base.RoundTrip(request)
+	if err != nil {
+		// the request may just as well have been abandoned because the build was cancelled,
+		// which is up to the caller to check with bc.Cancelled()
+		return nil, &Error{Kind: ErrAwxUnreachable, Err: err}
+	}
+
+	// same check awx-go does, anything outside of 2xx is an error
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		defer response.Body.Close()
+		body, _ := io.ReadAll(io.LimitReader(response.Body, 4096))
+		return nil, &AwxStatusError{Method: request.Method, URL: request.URL.Redacted(), StatusCode: response.StatusCode, Body: string(body)}
+	}
+
+	return response, nil
+}
+
+// awxError gives a call to AWX that took longer than awxRequestTimeout the ErrAwxUnreachable kind,
+// http.Client replaces the error of awxTransport with its own when the timeout is hit
+func awxError(err error) error {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return &Error{Kind: ErrAwxUnreachable, Err: err}
+	}
+	return err
+}
+
+// withContext returns a copy of client whose requests are bound to ctx
+func withContext(ctx context.Context, client *http.Client) *http.Client {
+	ctxClient := *client
+	ctxClient.Transport = &contextTransport{ctx: ctx, base: client.Transport}
+	return &ctxClient
+}
+
+// contextTransport sends every request with its context, so they're abandoned once it's done
+type contextTransport struct {
+	ctx  context.Context
+	base http.RoundTripper
+}
+
+func (t *contextTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return base.RoundTrip(request.WithContext(t.ctx))
+}
+
+// bearerTransport replaces the Authorization header of every request with an OAuth2 token
+type bearerTransport struct {
+	token string
+	base  http.RoundTripper
+}
+
+func (t *bearerTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	// a RoundTripper isn't supposed to modify the request it was given
+	request = request.Clone(request.Context())
+	request.Header.Set("Authorization", "Bearer "+t.token)
+
+	return base.RoundTrip(request)
+}
+
+// GetJSON sends a GET request to an AWX API endpoint and decodes the JSON response into result
+func (a *AwxClient) GetJSON(ctx context.Context, endpoint string, params map[string]string, result interface{}) error {
+	query := make(url.Values)
+	for key, value := range params {
+		query.Set(key, value)
+	}
+
+	requestURL := a.baseURL + endpoint
+	if len(query) > 0 {
+		requestURL += "?" + query.Encode()
+	}
+
+	return a.do(ctx, http.MethodGet, requestURL, nil, result)
+}
+
+// PostJSON sends data as JSON to an AWX API endpoint and decodes the JSON response into result
+func (a *AwxClient) PostJSON(ctx context.Context, endpoint string, data interface{}, result interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("PostJSON(): json.Marshal(): %w", err)
+	}
+
+	return a.do(ctx, http.MethodPost, a.baseURL+endpoint, bytes.NewReader(payload), result)
+}
+
+// do sends a request to AWX, it's abandoned as soon as ctx is done, ex. when the build is cancelled
+func (a *AwxClient) do(ctx context.Context, method, requestURL string, body io.Reader, result interface{}) error {
+	request, err := http.NewRequestWithContext(ctx, method, requestURL, body)
+	if err != nil {
+		return fmt.Errorf("http.NewRequestWithContext(): %w", err)
+	}
+	if a.token != "" {
+		request.Header.Set("Authorization", "Bearer "+a.token)
+	} else {
+		request.SetBasicAuth(a.username, a.password)
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := a.client.Do(request)
+	if err != nil {
+		return fmt.Errorf("%v %v: %w", method, requestURL, awxError(err))
+	}
+	defer response.Body.Close()
+
+	// awxTransport already turned anything outside of 2xx into an *AwxStatusError
+	respBody, err := io.ReadAll(response.Body)
+	if err != nil {
+		return fmt.Errorf("%v %v: io.ReadAll(): %w", method, requestURL, awxError(err))
+	}
+
+	if result == nil || len(respBody) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(respBody, result); err != nil {
+		return fmt.Errorf("%v %v: json.Unmarshal(): %w", method, requestURL, err)
+	}
+
+	return nil
+}
@@ -16,13 +16,24 @@ go build
 %install
 mkdir -p $RPM_BUILD_ROOT/usr/bin
 mkdir -p $RPM_BUILD_ROOT/usr/lib/systemd/system/
+mkdir -p $RPM_BUILD_ROOT/etc/awxclient
+mkdir -p $RPM_BUILD_ROOT/var/lib/awxclient
 cp /root/awxclient/awxclient $RPM_BUILD_ROOT/usr/bin
 cp /root/awxclient/systemd/*.service $RPM_BUILD_ROOT/usr/lib/systemd/system/
+cp /root/awxclient/config/inventories.json $RPM_BUILD_ROOT/etc/awxclient/
+cp /root/awxclient/config/relay.keys $RPM_BUILD_ROOT/etc/awxclient/
+cp /root/awxclient/config/relay-clients.json $RPM_BUILD_ROOT/etc/awxclient/
+cp /root/awxclient/config/awx.conf $RPM_BUILD_ROOT/etc/awxclient/
 
 %files
 /usr/bin/awxclient
 /usr/lib/systemd/system/awx-relay.service
 /usr/lib/systemd/system/awxclient.service
+%config(noreplace) /etc/awxclient/inventories.json
+%config(noreplace) %attr(0600, root, root) /etc/awxclient/relay.keys
+%config(noreplace) /etc/awxclient/relay-clients.json
+%config(noreplace) /etc/awxclient/awx.conf
+%dir /var/lib/awxclient
 
 %clean
 rm -rf $RPM_BUILD_ROOT
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// the AWX server used when nothing else is configured
+const defaultAwxURL = "https://awx.internaldomain.co"
+
+// how long a single request to AWX can take, so a hung call can't outlast the timeout of a step or a cancellation
+const awxRequestTimeout = 2 * time.Minute
+
+// AwxOptions are the options shared by every subcommand that talks to AWX. Options that
+// aren't set on the command line or in the environment are read from the config file
+type AwxOptions struct {
+	AwxConfigFile string `long:"awxconfig" description:"File of key=value lines with the AWX settings below, ex. url=https://awx.example.com" default:"/etc/awxclient/awx.conf"`
+	AwxURL        string `long:"awxurl" env:"AWX_URL" description:"URL of the AWX server"`
+	AwxCABundle   string `long:"awxca" env:"AWX_CA_BUNDLE" description:"CA certificate(s) the certificate of AWX is verified against, defaults to the system's trusted CAs"`
+	AwxCert       string `long:"awxcert" env:"AWX_CLIENT_CERT" description:"Client certificate presented to AWX"`
+	AwxKey        string `long:"awxkey" env:"AWX_CLIENT_KEY" description:"Private key of the client certificate presented to AWX"`
+	AwxInsecure   bool   `long:"awxinsecure" env:"AWX_INSECURE" description:"Don't verify the certificate of AWX, only meant for testing"`
+	AwxClientID   string `long:"awxclientid" env:"AWX_OAUTH_CLIENT_ID" description:"Client ID of the AWX OAuth2 application used to trade the username and password for a token that's revoked at the end of the build"`
+	AwxSecret     string `long:"awxclientsecret" env:"AWX_OAUTH_CLIENT_SECRET" description:"Client secret of the AWX OAuth2 application, only needed for confidential applications"`
+	AwxCreds      string `long:"awxcreds" env:"AWX_CREDENTIALS" description:"Where the AWX credentials are read from: file:[path], env, systemd or encrypted:[path] (default: file:/var/tmp/.tower_creds)"`
+	AwxCredsKey   string `long:"awxcredskey" env:"AWX_CREDENTIALS_KEY" description:"Host-local key the encrypted:[path] credentials are decrypted with (default: /etc/awxclient/creds.key)"`
+}
+
+// AwxConfig is how to reach AWX once the flags, environment and config file are combined
+type AwxConfig struct {
+	URL        string
+	CABundle   string
+	ClientCert string
+	ClientKey  string
+	Insecure   bool
+
+	OAuthClientID     string
+	OAuthClientSecret string
+
+	Credentials CredentialProvider
+}
+
+// Load combines the options with the config file, the command line and environment win over the file.
+// The relay reads its credentials from relay_credentials in the config file, if it's set, since
+// the relay usually doesn't get its credentials the same way as the hosts being built
+func (o *AwxOptions) Load(relay bool) (AwxConfig, error) {
+	var credsSource, relayCredsSource, credsKey string
+
+	config := AwxConfig{
+		URL:        o.AwxURL,
+		CABundle:   o.AwxCABundle,
+		ClientCert: o.AwxCert,
+		ClientKey:  o.AwxKey,
+		Insecure:   o.AwxInsecure,
+
+		OAuthClientID:     o.AwxClientID,
+		OAuthClientSecret: o.AwxSecret,
+	}
+
+	// the config file is optional, without it the defaults are used
+	if o.AwxConfigFile != "" {
+		if _, err := os.Stat(o.AwxConfigFile); !errors.Is(err, os.ErrNotExist) {
+			data, err := ReadFile(o.AwxConfigFile)
+			if err != nil {
+				return config, fmt.Errorf("AwxOptions.Load(): %w", err)
+			}
+
+			for key, value := range data {
+				value = strings.TrimSpace(value)
+				switch strings.TrimSpace(key) {
+				case "url":
+					config.URL = firstSet(config.URL, value)
+				case "ca_bundle":
+					config.CABundle = firstSet(config.CABundle, value)
+				case "client_cert":
+					config.ClientCert = firstSet(config.ClientCert, value)
+				case "client_key":
+					config.ClientKey = firstSet(config.ClientKey, value)
+				case "insecure":
+					config.Insecure = config.Insecure || value == "true"
+				case "oauth_client_id":
+					config.OAuthClientID = firstSet(config.OAuthClientID, value)
+				case "oauth_client_secret":
+					config.OAuthClientSecret = firstSet(config.OAuthClientSecret, value)
+				case "credentials":
+					credsSource = value
+				case "relay_credentials":
+					relayCredsSource = value
+				case "credentials_key":
+					credsKey = value
+				}
+			}
+		}
+	}
+
+	config.URL = strings.TrimSuffix(firstSet(config.URL, defaultAwxURL), "/")
+
+	if !strings.HasPrefix(config.URL, "https://") && !strings.HasPrefix(config.URL, "http://") {
+		return config, NewError(ErrConfig, "the AWX URL %q needs to start with https:// or http://", config.URL)
+	}
+	if (config.ClientCert == "") != (config.ClientKey == "") {
+		return config, NewError(ErrConfig, "the AWX client certificate and its key have to be set together")
+	}
+
+	if relay {
+		credsSource = firstSet(relayCredsSource, credsSource)
+	}
+	credsSource = firstSet(o.AwxCreds, credsSource, "file:"+defaultCredentialsFile)
+	credsKey = firstSet(o.AwxCredsKey, credsKey, defaultCredentialsKey)
+
+	var err error
+	if config.Credentials, err = NewCredentialProvider(credsSource, credsKey); err != nil {
+		return config, err
+	}
+
+	return config, nil
+}
+
+// HTTPClient returns the client used for every request to AWX
+func (c AwxConfig) HTTPClient() (*http.Client, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12, InsecureSkipVerify: c.Insecure}
+
+	if c.CABundle != "" {
+		pool, err := LoadCertPool(c.CABundle)
+		if err != nil {
+			return nil, fmt.Errorf("AwxConfig.HTTPClient(): %w", err)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if c.ClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(c.ClientCert, c.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("AwxConfig.HTTPClient(): tls.LoadX509KeyPair(): %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return &http.Client{
+		Transport: &awxTransport{base: &http.Transport{TLSClientConfig: tlsConfig}},
+		Timeout:   awxRequestTimeout,
+	}, nil
+}
+
+// firstSet returns the first value which isn't empty
+func firstSet(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how often the relay enforces the retention of the build logs
+const buildLogPruneInterval = time.Hour
+
+// StatusLogger writes the human-readable log of a build to a file, the relay keeps one per build
+type StatusLogger struct {
+	mu      sync.Mutex
+	logfile string
+}
+
+// NewStatusLogger creates a logger which writes to logfile
+func NewStatusLogger(logfile string) *StatusLogger {
+	return &StatusLogger{logfile: logfile}
+}
+
+// the methods below are safe to call on a nil *StatusLogger, which is what foreman uses
+// since it only logs to STDOUT
+
+// Path returns the file the logger writes to
+func (l *StatusLogger) Path() string {
+	if l == nil {
+		return ""
+	}
+	return l.logfile
+}
+
+// Print appends the output to the logfile of the logger
+func (l *StatusLogger) Print(msg string) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	f, err := os.OpenFile(l.logfile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("PrintStatus(): os.OpenFile(): %w", err)
+	}
+
+	if _, err := f.WriteString(strings.TrimSuffix(msg, "\n") + "\n"); err != nil {
+		f.Close() // ignore error; Write error takes precedence
+		return fmt.Errorf("PrintStatus(): f.WriteString(): %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("PrintStatus(): f.Close(): %w", err)
+	}
+
+	return nil
+}
+
+// BuildLogs keeps a log file per build in a directory per host, [dir]/[fqdn]/[timestamp]-[build ID].log.
+// [dir]/[fqdn].log always links to the log of the most recent build of the host
+type BuildLogs struct {
+	Dir     string
+	MaxAge  time.Duration // logs older than this are removed, 0 keeps them forever
+	MaxSize int64         // the oldest logs are removed once all of them take up more bytes than this, 0 for no limit
+}
+
+// Latest returns the path which links to the log of the most recent build of an FQDN
+func (l *BuildLogs) Latest(fqdn string) string {
+	return filepath.Join(l.Dir, fqdn+".log")
+}
+
+// Open returns the logger of a build. A build that is resumed carries on writing to its
+// log, otherwise a new log is created and becomes the latest log of the host
+func (l *BuildLogs) Open(fqdn, buildID string) (*StatusLogger, error) {
+	if err := ValidateFQDN(fqdn); err != nil {
+		return nil, err
+	}
+
+	hostDir := filepath.Join(l.Dir, fqdn)
+	if err := os.MkdirAll(hostDir, 0775); err != nil {
+		return nil, fmt.Errorf("BuildLogs.Open(): os.MkdirAll(): %w", err)
+	}
+
+	// logs written before there was a log per build are kept along with the others
+	if err := l.adoptLegacyLog(fqdn); err != nil {
+		return nil, fmt.Errorf("BuildLogs.Open(): %w", err)
+	}
+
+	existing, err := filepath.Glob(filepath.Join(hostDir, "*-"+buildID+".log"))
+	if err != nil {
+		return nil, fmt.Errorf("BuildLogs.Open(): filepath.Glob(): %w", err)
+	}
+	if len(existing) > 0 {
+		return NewStatusLogger(existing[0]), nil
+	}
+
+	name := fmt.Sprintf("%v-%v.log", time.Now().UTC().Format("20060102T150405Z"), buildID)
+	buildLog := NewStatusLogger(filepath.Join(hostDir, name))
+	if err := buildLog.Print(fmt.Sprintf("Build Date: %v\nBuild ID: %v", GetTime("full"), buildID)); err != nil {
+		return nil, fmt.Errorf("BuildLogs.Open(): %w", err)
+	}
+
+	// replace the link in one go so it never points nowhere
+	tmpLink := l.Latest(fqdn) + ".tmp"
+	os.Remove(tmpLink)
+	if err := os.Symlink(filepath.Join(fqdn, name), tmpLink); err != nil {
+		return nil, fmt.Errorf("BuildLogs.Open(): os.Symlink(): %w", err)
+	}
+	if err := os.Rename(tmpLink, l.Latest(fqdn)); err != nil {
+		return nil, fmt.Errorf("BuildLogs.Open(): os.Rename(): %w", err)
+	}
+
+	return buildLog, nil
+}
+
+// adoptLegacyLog moves the single log file older versions of the relay appended every build of a host to
+func (l *BuildLogs) adoptLegacyLog(fqdn string) error {
+	info, err := os.Lstat(l.Latest(fqdn))
+	if errors.Is(err, os.ErrNotExist) || (err == nil && !info.Mode().IsRegular()) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("adoptLegacyLog(): os.Lstat(): %w", err)
+	}
+
+	name := fmt.Sprintf("%v-legacy.log", info.ModTime().UTC().Format("20060102T150405Z"))
+	if err := os.Rename(l.Latest(fqdn), filepath.Join(l.Dir, fqdn, name)); err != nil {
+		return fmt.Errorf("adoptLegacyLog(): os.Rename(): %w", err)
+	}
+
+	return nil
+}
+
+type buildLogFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// Prune removes the logs that are older than MaxAge, and then the oldest ones until they take
+// up less than MaxSize. The latest log of every host is always kept, its build may still be running
+func (l *BuildLogs) Prune() error {
+	paths, err := filepath.Glob(filepath.Join(l.Dir, "*", "*.log"))
+	if err != nil {
+		return fmt.Errorf("BuildLogs.Prune(): filepath.Glob(): %w", err)
+	}
+
+	var files []buildLogFile
+	var total int64
+	for _, path := range paths {
+		info, err := os.Lstat(path)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		fqdn := filepath.Base(filepath.Dir(path))
+		if latest, err := os.Readlink(l.Latest(fqdn)); err == nil && latest == filepath.Join(fqdn, filepath.Base(path)) {
+			continue
+		}
+		files = append(files, buildLogFile{path: path, size: info.Size(), modTime: info.ModTime()})
+		total += info.Size()
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+
+	for _, file := range files {
+		expired := l.MaxAge > 0 && time.Since(file.modTime) > l.MaxAge
+		tooBig := l.MaxSize > 0 && total > l.MaxSize
+		if !expired && !tooBig {
+			continue
+		}
+		if err := os.Remove(file.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("BuildLogs.Prune(): os.Remove(): %w", err)
+		}
+		total -= file.size
+	}
+
+	return nil
+}
+
+// PruneEvery enforces the retention of the logs now and then every interval, it doesn't return
+func (l *BuildLogs) PruneEvery(interval time.Duration) {
+	for {
+		if err := l.Prune(); err != nil {
+			logger.Errorf("%v", err)
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// build phases reported by the relay through GET /build/{id}
+const (
+	PhaseQueued    = "queued"
+	PhaseInventory = "inventory"
+	PhaseRunning   = "running"
+	PhaseFinished  = "finished"
+)
+
+// build results, only set once the build reaches PhaseFinished
+const (
+	ResultSuccessful = "successful"
+	ResultFailed     = "failed" // an AWX job failed, not a program issue
+	ResultError      = "error"  // something went wrong in awxclient or talking to AWX
+	ResultCancelled  = "cancelled"
+)
+
+// how long finished builds are kept around so clients can still fetch their result
+const buildRetention = 24 * time.Hour
+
+// how many events of a build are kept for clients that connect late or reconnect
+const buildEventHistory = 2000
+
+// types of the events streamed through GET /build/{id}/events
+const (
+	EventLog      = "log"      // a line of the build log
+	EventPhase    = "phase"    // the build moved on to another phase, step or AWX job
+	EventFinished = "finished" // the build finished, always the last event
+)
+
+// BuildStatus is the snapshot of a build that is sent to the client
+type BuildStatus struct {
+	ID       string       `json:"id"`
+	FQDN     string       `json:"fqdn"`
+	Phase    string       `json:"phase"`
+	Step     string       `json:"step"`
+	JobID    int          `json:"jobid"`
+	Steps    []StepResult `json:"steps"`
+	Result   string       `json:"result"`
+	Error    *RelayError  `json:"error,omitempty"`
+	Started  string       `json:"started"`
+	Finished string       `json:"finished"`
+}
+
+// BuildEvent is something that happened during a build, the ID of the events of a build goes up by one each time
+type BuildEvent struct {
+	ID      int    `json:"id"`
+	Type    string `json:"type"`
+	Time    string `json:"time"`
+	Level   string `json:"level,omitempty"`
+	Message string `json:"message,omitempty"`
+	Phase   string `json:"phase,omitempty"`
+	Step    string `json:"step,omitempty"`
+	JobID   int    `json:"jobid,omitempty"`
+	Result  string `json:"result,omitempty"`
+}
+
+// Build tracks a single build that the relay is running in the background
+type Build struct {
+	mu       sync.Mutex
+	status   BuildStatus
+	facility string
+	finished time.Time
+	ctx      context.Context // cancelled by Cancel()
+	cancel   context.CancelFunc
+
+	events      []BuildEvent // the most recent events, see buildEventHistory
+	lastEvent   int
+	subscribers map[chan BuildEvent]struct{}
+}
+
+// BuildRegistry holds all the builds the relay knows about
+type BuildRegistry struct {
+	mu     sync.Mutex
+	builds map[string]*Build
+}
+
+var builds = &BuildRegistry{builds: make(map[string]*Build)}
+
+// New registers a new queued build for an FQDN in facility and returns it. An FQDN only ever has one
+// build running, if there already is one it's returned instead along with true. The ID of a
+// build resumed from its state file is passed in, otherwise id is empty and a new one is made
+func (r *BuildRegistry) New(fqdn, facility, id string) (*Build, bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, value := range r.builds {
+		if value.isActive(fqdn) {
+			return value, true, nil
+		}
+	}
+
+	if id == "" {
+		var err error
+		if id, err = NewBuildID(); err != nil {
+			return nil, false, fmt.Errorf("BuildRegistry.New(): %w", err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	b := &Build{
+		status: BuildStatus{
+			ID:      id,
+			FQDN:    fqdn,
+			Phase:   PhaseQueued,
+			Started: GetTime("full"),
+		},
+		facility: facility,
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+
+	// drop builds that finished a long time ago so the map doesn't grow forever
+	for key, value := range r.builds {
+		if value.isExpired() {
+			delete(r.builds, key)
+		}
+	}
+	r.builds[id] = b
+
+	return b, false, nil
+}
+
+// Get returns the build matching an ID, or nil if the relay doesn't know about it
+func (r *BuildRegistry) Get(id string) *Build {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.builds[id]
+}
+
+// NewBuildID generates a random ID for a build
+func NewBuildID() (string, error) {
+	data := make([]byte, 8)
+	if _, err := rand.Read(data); err != nil {
+		return "", fmt.Errorf("NewBuildID(): rand.Read(): %w", err)
+	}
+	return hex.EncodeToString(data), nil
+}
+
+// the methods below are safe to call on a nil *Build, which is what internal
+// builds use since nobody is polling for their status
+
+// Status returns a copy of the current state of the build
+func (b *Build) Status() BuildStatus {
+	if b == nil {
+		return BuildStatus{}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	status := b.status
+	status.Steps = append([]StepResult(nil), b.status.Steps...)
+	return status
+}
+
+// Facility returns the facility of the host being built
+func (b *Build) Facility() string {
+	if b == nil {
+		return ""
+	}
+	return b.facility
+}
+
+// Context is cancelled once the build is cancelled, builds that can't be cancelled get a context that never is
+func (b *Build) Context() context.Context {
+	if b == nil || b.ctx == nil {
+		return context.Background()
+	}
+	return b.ctx
+}
+
+// Cancel asks the build to stop, it returns false if the build has already finished.
+// The build finishes as cancelled once it has cancelled the AWX job it was waiting on
+func (b *Build) Cancel() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.status.Phase == PhaseFinished {
+		return false
+	}
+	if b.cancel != nil {
+		b.cancel()
+	}
+	return true
+}
+
+// SetPhase records which phase and step the build is currently in
+func (b *Build) SetPhase(phase, step string) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.status.Phase = phase
+	b.status.Step = step
+	b.status.JobID = 0
+	b.publish(BuildEvent{Type: EventPhase, Phase: phase, Step: step})
+}
+
+// SetJobID records the ID of the AWX job currently running for the build
+func (b *Build) SetJobID(jobID int) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.status.JobID = jobID
+	b.publish(BuildEvent{Type: EventPhase, Phase: b.status.Phase, Step: b.status.Step, JobID: jobID})
+}
+
+// SetSteps records the results of the pipeline steps so far
+func (b *Build) SetSteps(results []StepResult) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.status.Steps = append([]StepResult(nil), results...)
+}
+
+// Finish marks the build as finished with its final result
+func (b *Build) Finish(result string, err *RelayError) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.status.Phase = PhaseFinished
+	b.status.Result = result
+	b.status.Error = err
+	b.status.Finished = GetTime("full")
+	b.finished = time.Now()
+	if b.cancel != nil {
+		b.cancel()
+	}
+	b.publish(BuildEvent{Type: EventFinished, Phase: PhaseFinished, Result: result})
+
+	// nothing else happens once the build has finished, so the streams can end
+	for ch := range b.subscribers {
+		close(ch)
+		delete(b.subscribers, ch)
+	}
+}
+
+// Log records a line of the build log, prefixed with INFO:, ERROR: etc.
+func (b *Build) Log(msg string) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	level, text := splitLevel(strings.TrimSuffix(msg, "\n"))
+	b.publish(BuildEvent{Type: EventLog, Level: strings.ToLower(level.String()), Message: text})
+}
+
+// Subscribe returns the events that happened after the event with the ID after, and a
+// channel receiving the events from now on. The channel is closed once the build has
+// finished, or if the subscriber falls too far behind, and unsubscribe has to be called
+// when the subscriber stops reading
+func (b *Build) Subscribe(after int) (backlog []BuildEvent, events <-chan BuildEvent, unsubscribe func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, event := range b.events {
+		if event.ID > after {
+			backlog = append(backlog, event)
+		}
+	}
+
+	ch := make(chan BuildEvent, 256)
+	if b.status.Phase == PhaseFinished {
+		close(ch)
+		return backlog, ch, func() {}
+	}
+
+	if b.subscribers == nil {
+		b.subscribers = make(map[chan BuildEvent]struct{})
+	}
+	b.subscribers[ch] = struct{}{}
+
+	return backlog, ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		if _, ok := b.subscribers[ch]; ok {
+			close(ch)
+			delete(b.subscribers, ch)
+		}
+	}
+}
+
+// publish records an event and sends it to the subscribers, b.mu has to be held
+func (b *Build) publish(event BuildEvent) {
+	b.lastEvent++
+	event.ID = b.lastEvent
+	event.Time = GetTime("full")
+
+	b.events = append(b.events, event)
+	if len(b.events) > buildEventHistory {
+		b.events = b.events[len(b.events)-buildEventHistory:]
+	}
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+			// a subscriber that can't keep up is dropped rather than holding up the build,
+			// it catches up from the history when it reconnects
+			close(ch)
+			delete(b.subscribers, ch)
+		}
+	}
+}
+
+func (b *Build) isExpired() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.status.Phase == PhaseFinished && time.Since(b.finished) > buildRetention
+}
+
+func (b *Build) isActive(fqdn string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.status.FQDN == fqdn && b.status.Phase != PhaseFinished
+}
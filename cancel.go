@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// how often awxclient cancel checks whether the build has stopped, and for how long
+const cancelPollInterval = 2 * time.Second
+const cancelTimeout = 2 * time.Minute
+
+type CancelCommand struct {
+	FQDN     string `long:"fqdn" description:"FQDN of the host whose build is cancelled, defaults to this host"`
+	BuildID  string `short:"b" long:"build" description:"ID of the build on the AWX relay, defaults to the build in the state of the host"`
+	Relay    string `long:"relay" description:"AWX relay the build runs on, defaults to mtrelay in the environment file left by Foreman"`
+	StateDir string `short:"s" long:"statedir" description:"Directory the state of each build is kept in" default:"/var/lib/awxclient"`
+
+	RelayOptions `group:"Relay Options"`
+	LogOptions   `group:"Logging Options"`
+}
+
+var cancelCommand CancelCommand
+
+func init() {
+	parser.AddCommand("cancel", "Cancels a build running on the AWX relay", "Cancels a build running on the AWX relay along with the AWX job it's waiting on, the host can then be built again with awxclient foreman", &cancelCommand)
+}
+
+// Main function for the cancel subcommand
+func (c *CancelCommand) Execute(args []string) error {
+	if err := c.LogOptions.Setup(); err != nil {
+		return fmt.Errorf("cancel: %w", err)
+	}
+
+	fqdn := c.FQDN
+	if fqdn == "" {
+		var err error
+		if fqdn, err = os.Hostname(); err != nil {
+			return fmt.Errorf("cancel: os.Hostname(): %w", err)
+		}
+	}
+
+	state, err := LoadBuildState(c.StateDir, fqdn)
+	if err != nil {
+		return fmt.Errorf("cancel: %w", err)
+	}
+
+	buildID := c.BuildID
+	if buildID == "" {
+		if state.JobVars.Type == "internal" {
+			return fmt.Errorf("cancel: internal builds don't run on the AWX relay, stop awxclient.service instead")
+		}
+		if buildID = state.RelayBuildID(); buildID == "" {
+			return fmt.Errorf("cancel: %v doesn't have a build running on the AWX relay, pass its ID with --build", fqdn)
+		}
+	}
+
+	host := c.Relay
+	if host == "" {
+		foremanVars, err := ReadForemanVars()
+		if err != nil {
+			return fmt.Errorf("cancel: %w, pass the AWX relay with --relay", err)
+		}
+		host = foremanVars.Relay
+	}
+
+	key, err := ReadRelayKey()
+	if err != nil {
+		return fmt.Errorf("cancel: %w", err)
+	}
+
+	relay, err := NewRelayClient(host, key, &c.RelayOptions)
+	if err != nil {
+		return fmt.Errorf("cancel: %w", err)
+	}
+
+	build, err := cancelRelayBuild(relay, buildID)
+	if err != nil {
+		return fmt.Errorf("cancel: %w", err)
+	}
+
+	fields := LogFields{FQDN: build.FQDN, BuildID: build.ID}
+
+	// the next run of awxclient foreman starts a new build rather than reattaching to this one
+	if state.RelayBuildID() == build.ID && build.Result == ResultCancelled {
+		if err := state.Finish(ResultCancelled); err != nil {
+			logger.Log(LevelError, fmt.Sprintf("couldn't save the build state: %v", err), fields)
+		}
+	}
+
+	if build.Result != ResultCancelled {
+		logger.Log(LevelInfo, fmt.Sprintf("The build had already finished with result %v, there was nothing to cancel", build.Result), fields)
+		return nil
+	}
+	logger.Log(LevelInfo, "Cancelled the build, run awxclient foreman to build it again", fields)
+
+	return nil
+}
+
+// cancelRelayBuild asks the relay to cancel a build and waits until it has stopped
+func cancelRelayBuild(relay *RelayClient, buildID string) (BuildStatus, error) {
+	var build BuildStatus
+
+	r, respBody, err := relay.Do(http.MethodDelete, "/build/"+buildID, nil)
+	if err != nil {
+		return build, fmt.Errorf("cancelRelayBuild(): %w", err)
+	}
+	if r.StatusCode != http.StatusOK && r.StatusCode != http.StatusAccepted {
+		return build, relayErrorFromBody(r.Status, respBody)
+	}
+	if err := json.Unmarshal(respBody, &build); err != nil {
+		return build, fmt.Errorf("cancelRelayBuild(): json.Unmarshal(): %w", err)
+	}
+
+	if build.Phase != PhaseFinished {
+		logger.Log(LevelInfo, "Cancelling the build, waiting for the AWX Relay to stop it...", LogFields{FQDN: build.FQDN, BuildID: build.ID})
+	}
+
+	deadline := time.Now().Add(cancelTimeout)
+	for build.Phase != PhaseFinished {
+		if time.Now().After(deadline) {
+			return build, NewError(ErrTimeout, "build %v was still %v after %v, check the log of the AWX Relay", build.ID, build.Phase, cancelTimeout)
+		}
+		time.Sleep(cancelPollInterval)
+
+		if build, err = getBuildStatus(relay, buildID); err != nil {
+			return build, fmt.Errorf("cancelRelayBuild(): %w", err)
+		}
+	}
+
+	return build, nil
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// where Foreman writes the AWX credentials of a host
+const defaultCredentialsFile = "/var/tmp/.tower_creds"
+
+// the host-local key encrypted credentials are decrypted with
+const defaultCredentialsKey = "/etc/awxclient/creds.key"
+
+// AwxCredentials are what AWX is authenticated to with, either a token or a user and password
+type AwxCredentials struct {
+	Username string
+	Password string
+	Token    string
+}
+
+// CredentialProvider is a source of AWX credentials
+type CredentialProvider interface {
+	// Credentials reads the credentials from the source
+	Credentials() (AwxCredentials, error)
+	// Remove gets rid of credentials that were only meant to be used for a single build
+	Remove() error
+	// String describes the source in messages
+	String() string
+}
+
+// NewCredentialProvider creates the provider for a source, which is one of
+//   - file:[path]       key=value file written by Foreman, ex. file:/var/tmp/.tower_creds
+//   - env               the AWX_USERNAME, AWX_PASSWORD and AWX_TOKEN environment variables
+//   - systemd           files passed in by systemd through LoadCredential= in $CREDENTIALS_DIRECTORY
+//   - encrypted:[path]  key=value file encrypted with the host-local key in keyFile
+func NewCredentialProvider(source, keyFile string) (CredentialProvider, error) {
+	switch {
+	case source == "env":
+		return &EnvCredentials{}, nil
+	case source == "systemd":
+		return &SystemdCredentials{}, nil
+	case strings.HasPrefix(source, "file:"):
+		return &FileCredentials{Path: strings.TrimPrefix(source, "file:")}, nil
+	case strings.HasPrefix(source, "encrypted:"):
+		if keyFile == "" {
+			return nil, NewError(ErrConfig, "encrypted AWX credentials need a key file")
+		}
+		return &EncryptedCredentials{Path: strings.TrimPrefix(source, "encrypted:"), KeyFile: keyFile}, nil
+	default:
+		return nil, NewError(ErrConfig, "unknown AWX credentials source %q, it has to be file:[path], env, systemd or encrypted:[path]", source)
+	}
+}
+
+// credentialsFromVars picks the credentials out of key=value pairs, as written by Foreman
+func credentialsFromVars(vars map[string]string) AwxCredentials {
+	return AwxCredentials{
+		Username: vars["user"],
+		Password: vars["pass"],
+		Token:    strings.TrimSpace(vars["token"]),
+	}
+}
+
+// check makes sure there's something to authenticate with
+func (c AwxCredentials) check(provider CredentialProvider) (AwxCredentials, error) {
+	if c.Token == "" && (c.Username == "" || c.Password == "") {
+		return c, NewError(ErrConfig, "%v doesn't contain an AWX token or user and password", provider)
+	}
+	return c, nil
+}
+
+// FileCredentials reads the plaintext key=value file written by Foreman
+type FileCredentials struct {
+	Path string
+}
+
+func (f *FileCredentials) Credentials() (AwxCredentials, error) {
+	vars, err := ReadFile(f.Path)
+	if err != nil {
+		return AwxCredentials{}, fmt.Errorf("FileCredentials.Credentials(): %w", err)
+	}
+	return credentialsFromVars(vars).check(f)
+}
+
+// Remove deletes the file, it's been written by Foreman for this build only
+func (f *FileCredentials) Remove() error {
+	if err := os.Remove(f.Path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("FileCredentials.Remove(): os.Remove(): %w", err)
+	}
+	return nil
+}
+
+func (f *FileCredentials) String() string {
+	return f.Path
+}
+
+// EnvCredentials reads the credentials from environment variables, ex. set by an EnvironmentFile= of the unit
+type EnvCredentials struct{}
+
+func (e *EnvCredentials) Credentials() (AwxCredentials, error) {
+	return AwxCredentials{
+		Username: os.Getenv("AWX_USERNAME"),
+		Password: os.Getenv("AWX_PASSWORD"),
+		Token:    os.Getenv("AWX_TOKEN"),
+	}.check(e)
+}
+
+func (e *EnvCredentials) Remove() error {
+	return nil
+}
+
+func (e *EnvCredentials) String() string {
+	return "the AWX_USERNAME, AWX_PASSWORD and AWX_TOKEN environment variables"
+}
+
+// SystemdCredentials reads the awx-user, awx-pass and awx-token files systemd
+// passes to the service in $CREDENTIALS_DIRECTORY
+type SystemdCredentials struct{}
+
+func (s *SystemdCredentials) Credentials() (AwxCredentials, error) {
+	dir := os.Getenv("CREDENTIALS_DIRECTORY")
+	if dir == "" {
+		return AwxCredentials{}, NewError(ErrConfig, "$CREDENTIALS_DIRECTORY isn't set, add LoadCredential= for awx-user and awx-pass or awx-token to the systemd unit")
+	}
+
+	var creds AwxCredentials
+	for name, value := range map[string]*string{"awx-user": &creds.Username, "awx-pass": &creds.Password, "awx-token": &creds.Token} {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return creds, fmt.Errorf("SystemdCredentials.Credentials(): os.ReadFile(): %w", err)
+		}
+		*value = strings.TrimSpace(string(data))
+	}
+
+	return creds.check(s)
+}
+
+// Remove does nothing, systemd removes the credentials once the service stops
+func (s *SystemdCredentials) Remove() error {
+	return nil
+}
+
+func (s *SystemdCredentials) String() string {
+	return "the systemd credentials in $CREDENTIALS_DIRECTORY"
+}
+
+// EncryptedCredentials reads a key=value file encrypted with AES-256-GCM by `awxclient encryptcreds`
+type EncryptedCredentials struct {
+	Path    string
+	KeyFile string
+}
+
+func (e *EncryptedCredentials) Credentials() (AwxCredentials, error) {
+	key, err := readCredentialsKey(e.KeyFile)
+	if err != nil {
+		return AwxCredentials{}, fmt.Errorf("EncryptedCredentials.Credentials(): %w", err)
+	}
+
+	data, err := os.ReadFile(e.Path)
+	if err != nil {
+		return AwxCredentials{}, fmt.Errorf("EncryptedCredentials.Credentials(): os.ReadFile(): %w", err)
+	}
+
+	plaintext, err := DecryptCredentials(key, string(data))
+	if err != nil {
+		return AwxCredentials{}, NewError(ErrConfig, "can't decrypt %v with the key in %v: %v", e.Path, e.KeyFile, err)
+	}
+
+	return credentialsFromVars(ParseVars(string(plaintext))).check(e)
+}
+
+// Remove does nothing, the encrypted file is meant to stay on the host
+func (e *EncryptedCredentials) Remove() error {
+	return nil
+}
+
+func (e *EncryptedCredentials) String() string {
+	return e.Path
+}
+
+// readCredentialsKey reads a hex encoded 256 bit key, ex. created with `openssl rand -hex 32`
+func readCredentialsKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("readCredentialsKey(): os.ReadFile(): %w", err)
+	}
+
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("readCredentialsKey(): %v has to contain a hex encoded 256 bit key", path)
+	}
+
+	return key, nil
+}
+
+// EncryptCredentials encrypts plaintext with AES-256-GCM, the result is the base64 encoded nonce and ciphertext
+func EncryptCredentials(key, plaintext []byte) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", fmt.Errorf("EncryptCredentials(): %w", err)
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", fmt.Errorf("EncryptCredentials(): rand.Read(): %w", err)
+	}
+
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, plaintext, nil)), nil
+}
+
+// DecryptCredentials reverses EncryptCredentials()
+func DecryptCredentials(key []byte, encrypted string) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encrypted))
+	if err != nil {
+		return nil, fmt.Errorf("base64 decoding: %w", err)
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, fmt.Errorf("the file is too short")
+	}
+
+	return gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("aes.NewCipher(): %w", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("cipher.NewGCM(): %w", err)
+	}
+	return gcm, nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+type EncryptCredsCommand struct {
+	Key    string `short:"k" long:"key" description:"Host-local key to encrypt the credentials with, a hex encoded 256 bit key ex. from openssl rand -hex 32" default:"/etc/awxclient/creds.key"`
+	Input  string `short:"i" long:"input" description:"Plaintext key=value file with user and pass, or token" default:"/var/tmp/.tower_creds"`
+	Output string `short:"o" long:"output" description:"Where the encrypted credentials are written" required:"true"`
+}
+
+var encryptCredsCommand EncryptCredsCommand
+
+func init() {
+	parser.AddCommand("encryptcreds", "Encrypts a file of AWX credentials", "Encrypts a file of AWX credentials with a host-local key, so they can be read with --awxcreds encrypted:[path]", &encryptCredsCommand)
+}
+
+// Main function for the encryptcreds subcommand
+func (e *EncryptCredsCommand) Execute(args []string) error {
+	key, err := readCredentialsKey(e.Key)
+	if err != nil {
+		return fmt.Errorf("encryptcreds: %w", err)
+	}
+
+	plaintext, err := os.ReadFile(e.Input)
+	if err != nil {
+		return fmt.Errorf("encryptcreds: os.ReadFile(): %w", err)
+	}
+
+	// make sure the file is usable before it's encrypted
+	if _, err := credentialsFromVars(ParseVars(string(plaintext))).check(&FileCredentials{Path: e.Input}); err != nil {
+		return err
+	}
+
+	encrypted, err := EncryptCredentials(key, plaintext)
+	if err != nil {
+		return fmt.Errorf("encryptcreds: %w", err)
+	}
+
+	if err := os.WriteFile(e.Output, []byte(encrypted+"\n"), 0600); err != nil {
+		return fmt.Errorf("encryptcreds: os.WriteFile(): %w", err)
+	}
+	fmt.Printf("INFO: Wrote the encrypted credentials to %v\n", e.Output)
+
+	return nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// the kinds of errors callers need to tell apart, checked with errors.Is(). Everything else is a program issue
+var (
+	ErrJobFailed      = errors.New("AWX job failed")
+	ErrAwxUnreachable = errors.New("AWX is unreachable")
+	ErrAuthDenied     = errors.New("AWX refused the credentials")
+	ErrUnauthorized   = errors.New("the relay refused the request")
+	ErrForbidden      = errors.New("the host isn't allowed to do this")
+	ErrNotFound       = errors.New("not found")
+	ErrDNSMismatch    = errors.New("DNS doesn't match Foreman")
+	ErrConfig         = errors.New("configuration is missing or invalid")
+	ErrNetwork        = errors.New("the network isn't connected")
+	ErrEnvFile        = errors.New("the Foreman environment file is missing or incomplete")
+	ErrAwxVars        = errors.New("can't fetch the awxvars file")
+	ErrTimeout        = errors.New("timed out")
+	ErrCleanUp        = errors.New("couldn't clean up after the build")
+	ErrCancelled      = errors.New("the build was cancelled")
+
+	// a job that did nothing on the host, it still failed so errors.Is(err, ErrJobFailed) holds as well
+	ErrSkippedAll = fmt.Errorf("every task was skipped on the host: %w", ErrJobFailed)
+)
+
+// these say why an AWX job failed, they always come wrapped in an ErrJobFailed error
+var (
+	ErrHostUnreachable = errors.New("Ansible couldn't reach the host")
+	ErrJobError        = errors.New("AWX couldn't run the job")
+)
+
+// exit codes of the foreman subcommand
+const (
+	ExitSuccess        = 0
+	ExitProgramError   = 1 // a bug or something unexpected, reach out to Platform Engineering
+	ExitJobFailed      = 2
+	ExitConfig         = 3
+	ExitDNSMismatch    = 4
+	ExitAuthDenied     = 5
+	ExitAwxUnreachable = 6
+	ExitNetwork        = 7
+	ExitEnvFile        = 8
+	ExitAwxVars        = 9
+	ExitTimeout        = 10
+	ExitCleanUp        = 11
+	ExitCancelled      = 12
+	ExitSkippedAll     = 13
+)
+
+// kinds maps each kind of error to the code the relay reports it with, the HTTP status
+// the relay responds with when a request fails with it, and the exit code of the client.
+// Kinds which are also another kind come first, the first one that matches wins
+var kinds = []struct {
+	kind     error
+	code     string
+	status   int
+	exitCode int
+}{
+	{ErrSkippedAll, ErrCodeSkippedAll, http.StatusUnprocessableEntity, ExitSkippedAll},
+	{ErrJobFailed, ErrCodeJobFailed, http.StatusUnprocessableEntity, ExitJobFailed},
+	{ErrAwxUnreachable, ErrCodeAwxUnreachable, http.StatusBadGateway, ExitAwxUnreachable},
+	{ErrAuthDenied, ErrCodeAwxCredentials, http.StatusBadGateway, ExitAuthDenied},
+	{ErrUnauthorized, ErrCodeUnauthorized, http.StatusUnauthorized, ExitAuthDenied},
+	{ErrForbidden, ErrCodeForbidden, http.StatusForbidden, ExitAuthDenied},
+	{ErrNotFound, ErrCodeNotFound, http.StatusNotFound, ExitProgramError},
+	{ErrDNSMismatch, ErrCodeDNSMismatch, http.StatusBadRequest, ExitDNSMismatch},
+	{ErrConfig, ErrCodeConfiguration, http.StatusBadRequest, ExitConfig},
+	{ErrNetwork, ErrCodeNetwork, http.StatusServiceUnavailable, ExitNetwork},
+	{ErrEnvFile, ErrCodeEnvFile, http.StatusBadRequest, ExitEnvFile},
+	{ErrAwxVars, ErrCodeAwxVars, http.StatusBadRequest, ExitAwxVars},
+	{ErrTimeout, ErrCodeTimeout, http.StatusGatewayTimeout, ExitTimeout},
+	{ErrCleanUp, ErrCodeCleanUp, http.StatusInternalServerError, ExitCleanUp},
+	{ErrCancelled, ErrCodeCancelled, http.StatusConflict, ExitCancelled},
+}
+
+// Error is an error of a kind the user can do something about
+type Error struct {
+	Kind error
+	Err  error
+}
+
+// NewError creates an error of kind, the message is what the user sees
+func NewError(kind error, format string, args ...interface{}) error {
+	return &Error{Kind: kind, Err: fmt.Errorf(format, args...)}
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func (e *Error) Is(target error) bool {
+	return errors.Is(e.Kind, target)
+}
+
+// Wrap adds the name of the function to program errors, errors of a known kind are passed
+// on as they are so the message the user sees stays readable
+func Wrap(function string, err error) error {
+	if err == nil || ErrorCode(err) != ErrCodeInternal {
+		return err
+	}
+	return fmt.Errorf("%v: %w", function, err)
+}
+
+// ErrorCode returns the relay error code of the kind of err
+func ErrorCode(err error) string {
+	for _, k := range kinds {
+		if errors.Is(err, k.kind) {
+			return k.code
+		}
+	}
+	return ErrCodeInternal
+}
+
+// HTTPStatus returns the status the relay responds with when a request fails with err
+func HTTPStatus(err error) int {
+	for _, k := range kinds {
+		if errors.Is(err, k.kind) {
+			return k.status
+		}
+	}
+	return http.StatusInternalServerError
+}
+
+// ExitCode returns the exit code of the client for err
+func ExitCode(err error) int {
+	if err == nil {
+		return ExitSuccess
+	}
+	for _, k := range kinds {
+		if errors.Is(err, k.kind) {
+			return k.exitCode
+		}
+	}
+	return ExitProgramError
+}
+
+// kindOfCode returns the kind of error the relay reported with code, so errors.Is() works on the client too
+func kindOfCode(code string) error {
+	for _, k := range kinds {
+		if k.code == code {
+			return k.kind
+		}
+	}
+	return nil
+}
+
+// AwxStatusError is AWX responding with anything other than 2xx
+type AwxStatusError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Body       string
+}
+
+func (e *AwxStatusError) Error() string {
+	return fmt.Sprintf("%v %v: responded with %v: %v", e.Method, e.URL, e.StatusCode, e.Body)
+}
+
+func (e *AwxStatusError) Is(target error) bool {
+	return target == ErrAuthDenied && (e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// JobEvent is a single event of an AWX job, awx-go's version doesn't include the result message
+type JobEvent struct {
+	Counter   int    `json:"counter"`
+	Event     string `json:"event"`
+	HostName  string `json:"host_name"`
+	Task      string `json:"task"`
+	Stdout    string `json:"stdout"`
+	Failed    bool   `json:"failed"`
+	EventData struct {
+		IgnoreErrors bool                   `json:"ignore_errors"`
+		Res          map[string]interface{} `json:"res"`
+	} `json:"event_data"`
+}
+
+type jobEventsResponse struct {
+	Next    string     `json:"next"`
+	Results []JobEvent `json:"results"`
+}
+
+// strips the terminal colors Ansible adds to its output
+var ansiEscape = regexp.MustCompile(`\x1b\[[0-9;]*m`)
+
+// JobEventStream follows the events of an AWX job and writes the Ansible output
+// for the host being built into the build log
+type JobEventStream struct {
+	bc          *BuildContext
+	jobID       int
+	lastCounter int
+	failedTask  string
+	failedMsg   string
+	unreachable bool
+}
+
+// NewJobEventStream starts following the events of an AWX job from the beginning
+func NewJobEventStream(bc *BuildContext, jobID int) *JobEventStream {
+	return &JobEventStream{bc: bc, jobID: jobID}
+}
+
+// Poll writes every event that happened since the last call to the build log
+func (s *JobEventStream) Poll() error {
+	for {
+		var response jobEventsResponse
+		params := map[string]string{
+			"counter__gt": strconv.Itoa(s.lastCounter),
+			"order_by":    "counter",
+			"page_size":   "200",
+		}
+		endpoint := fmt.Sprintf("/api/v2/jobs/%v/job_events/", s.jobID)
+		if err := s.bc.AWX.GetJSON(s.bc.Context(), endpoint, params, &response); err != nil {
+			return fmt.Errorf("JobEventStream.Poll(): %w", err)
+		}
+
+		for _, event := range response.Results {
+			s.lastCounter = event.Counter
+			s.write(event)
+		}
+
+		// keep going until we've caught up with the job
+		if response.Next == "" || len(response.Results) == 0 {
+			return nil
+		}
+	}
+}
+
+// Unreachable says whether the task that failed couldn't reach the host
+func (s *JobEventStream) Unreachable() bool {
+	return s.unreachable
+}
+
+// Failure describes the task that failed on the host, or is empty if nothing failed
+func (s *JobEventStream) Failure() string {
+	if s.failedTask == "" {
+		return ""
+	}
+	if s.failedMsg == "" {
+		return fmt.Sprintf("task %q failed", s.failedTask)
+	}
+	return fmt.Sprintf("task %q failed: %v", s.failedTask, s.failedMsg)
+}
+
+func (s *JobEventStream) write(event JobEvent) {
+	// events without a host are plays, tasks and the recap, which give the output context
+	if event.HostName != "" && !strings.EqualFold(event.HostName, s.bc.FQDN) {
+		return
+	}
+
+	switch event.Event {
+	case "runner_on_failed", "runner_on_unreachable":
+		if !event.EventData.IgnoreErrors {
+			s.failedTask = event.Task
+			s.failedMsg = eventMessage(event)
+			s.unreachable = event.Event == "runner_on_unreachable"
+		}
+	}
+
+	stdout := strings.TrimSpace(ansiEscape.ReplaceAllString(event.Stdout, ""))
+	if stdout != "" {
+		s.bc.PrintStatus(stdout)
+	}
+}
+
+// eventMessage pulls the error message out of the result of a failed task
+func eventMessage(event JobEvent) string {
+	for _, key := range []string{"msg", "stderr", "reason"} {
+		if value, ok := event.EventData.Res[key].(string); ok && value != "" {
+			return strings.TrimSpace(value)
+		}
+	}
+	return ""
+}
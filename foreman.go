@@ -1,7 +1,7 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -20,9 +20,16 @@ import (
 )
 
 type ForemanOptions struct {
-	RelayPort string `short:"r" long:"relayport" description:"If the default port of the AWX relay was changed, set it here" default:"8080"`
-	Mock      string `short:"m" long:"mock" description:"Runs all the necessary functions, but doesn't actually launch any jobs and returns 'success'. Requires an FQDN as an argument."`
-	File      string `short:"f" long:"file" description:"Alternate location to read an AWX vars file from, can be local or via a web request. Requires JSON formatting."`
+	Mock        string `short:"m" long:"mock" description:"Runs all the necessary functions, but doesn't actually launch any jobs and returns 'success'. Requires an FQDN as an argument."`
+	File        string `short:"f" long:"file" description:"Alternate location to read an AWX vars file from, can be local or via a web request. Requires JSON formatting."`
+	Inventories string `short:"i" long:"inventories" description:"File mapping host types, distros and releases to AWX inventories, only used by internal builds" default:"/etc/awxclient/inventories.json"`
+	StateDir    string `short:"s" long:"statedir" description:"Directory the state of the build is kept in so it can resume after a reboot" default:"/var/lib/awxclient"`
+	StatusFile  string `long:"statusfile" description:"File the summary of the run is written to as JSON, for Foreman templates and monitoring" default:"/var/log/awxclient-status.json"`
+	Follow      bool   `long:"follow" description:"Mirror the log of the build on the AWX relay to the console as it happens"`
+
+	RelayOptions `group:"Relay Options"`
+	AwxOptions   `group:"AWX Options"`
+	LogOptions   `group:"Logging Options"`
 }
 
 type ForemanVars struct {
@@ -35,145 +42,346 @@ type ForemanVars struct {
 	Relay    string
 }
 
+// AwxVars only names the job templates and inventory, their IDs are looked up in AWX by KickoffJobs()
 type AwxVars struct {
-	BaselineName   string `json:"baselinename"`
-	BaselineID     int    `json:"baselineid"`
-	BreakglassName string `json:"breakglassname"`
-	BreakglassID   int    `json:"breakglassid"`
-	InventoryName  string `json:"inventoryname"`
-	InventoryID    int    `json:"inventoryid"`
-	Reboot         string `json:"reboot"`
+	InventoryName string     `json:"inventoryname"`
+	Reboot        string     `json:"reboot"`
+	Poll          PollPolicy `json:"poll"` // used by the steps that don't set their own
+	Steps         []Step     `json:"steps"`
 }
 
 var foremanOptions ForemanOptions
 
-// Hacky fix for PrintStatus()
-var fqdn string
-var hostType string
-
 func init() {
-	parser.AddCommand("foreman", "Execute Foreman post-install AWX jobs", "Launches Breakglass and Baseline AWX jobs for the respective environment", &foremanOptions)
+	parser.AddCommand("foreman", "Execute Foreman post-install AWX jobs", "Launches the AWX jobs listed in the awxvars file (ex. Breakglass and Baseline) for the respective environment", &foremanOptions)
 }
 
 // Main function for the the Foreman subcommand
 func (f *ForemanOptions) Execute(args []string) error {
+	var fqdn string
+	run := NewRunStatus()
+
+	if err := f.LogOptions.Setup(); err != nil {
+		return fmt.Errorf("foreman: %w", err)
+	}
+
 	// getting the hostname to execute jobs on
 	if f.Mock != "" {
 		fqdn = f.Mock
 	} else {
 		var err error
 		if fqdn, err = os.Hostname(); err != nil {
-			fmt.Println("ERROR: os.Hostname(): ", err)
-			os.Exit(1)
+			logger.Errorf("os.Hostname(): %v", err)
+			f.exit(run, err)
 		}
 	}
+	run.FQDN = fqdn
 
 	// "pre-flight" checks to ensure the jobs will launch correctly
 	jobVars, err := Prelaunch(fqdn)
-	hostType = jobVars.Type
+	jobVars.Mock = f.Mock
+	run.Type = jobVars.Type
 	if err != nil {
-		if strings.Contains(err.Error(), "failed") {
-			fmt.Println(err)
-		}
-		if strings.Contains(err.Error(), "(") {
-			fmt.Println(err)
-		} else {
-			fmt.Println(err)
-		}
-		os.Exit(1)
+		logger.Log(LevelError, err.Error(), LogFields{FQDN: fqdn, Type: jobVars.Type})
+		f.exit(run, err)
+	}
+
+	// all output is written to STDOUT, which is the console and the systemd journal
+	bc := &BuildContext{FQDN: fqdn, JobVars: jobVars, Run: run}
+
+	// picks up where the last run left off if it was interrupted, ex. by a reboot
+	if bc.State, err = LoadBuildState(f.StateDir, fqdn); err != nil {
+		bc.PrintStatus(fmt.Sprintf("ERROR: %v", err))
+		f.exit(run, err)
 	}
+	bc.CheckState(bc.State.SetJobVars(jobVars))
 
 	var status string
 
-	if hostType == "internal" {
-		status, err = internal(jobVars)
-	} else if hostType == "midtier" || hostType == "edge" {
-		status, err = client(jobVars)
+	if jobVars.Type == "internal" {
+		// only internal hosts talk to AWX themselves, midtier and edge leave that to the relay
+		if bc.Inventories, err = LoadInventoryMap(f.Inventories); err != nil {
+			bc.PrintStatus(fmt.Sprintf("ERROR: %v", err))
+			f.exit(run, &Error{Kind: ErrConfig, Err: err})
+		}
+		if bc.AwxConfig, err = f.AwxOptions.Load(false); err != nil {
+			bc.PrintStatus(fmt.Sprintf("ERROR: %v", err))
+			f.exit(run, err)
+		}
+		status, err = internal(bc)
+	} else if jobVars.Type == "midtier" || jobVars.Type == "edge" {
+		status, err = client(bc)
+	} else {
+		err = NewError(ErrEnvFile, "unknown host type %q, it has to be internal, midtier or edge", jobVars.Type)
 	}
 
 	if err != nil {
-		PrintStatus(fmt.Sprintf("ERROR: %v", err))
-		os.Exit(1)
+		// the token is revoked whatever the outcome, not just by CleanUp()
+		if revokeErr := bc.AWX.RevokeToken(); revokeErr != nil {
+			bc.PrintStatus(fmt.Sprintf("ERROR: %v", revokeErr))
+		}
+
+		if errors.Is(err, ErrJobFailed) {
+			bc.CheckState(bc.State.Finish(ResultFailed))
+		} else if errors.Is(err, ErrCancelled) {
+			bc.CheckState(bc.State.Finish(ResultCancelled))
+		} else {
+			bc.CheckState(bc.State.Finish(ResultError))
+		}
+
+		// the relay says what went wrong and what to do about it
+		var relayErr *RelayError
+		if errors.As(err, &relayErr) {
+			PrintRelayError(bc, relayErr)
+		} else {
+			bc.PrintStatus(fmt.Sprintf("ERROR: %v", err))
+		}
+		f.exit(run, err)
 	}
 
 	if strings.Contains(status, "successful") {
-		if err := CleanUp(jobVars.Reboot, foremanOptions.Mock); err != nil {
-			fmt.Println(err)
-			os.Exit(1)
+		bc.CheckState(bc.State.Finish(ResultSuccessful))
+		if err := CleanUp(bc); err != nil {
+			bc.PrintStatus(fmt.Sprintf("ERROR: %v", err))
+			f.exit(run, &Error{Kind: ErrCleanUp, Err: err})
 		}
-		msg := fmt.Sprintf("INFO: %v and %v completed successfully", jobVars.BreakglassName, jobVars.BaselineName)
-		PrintStatus(msg)
+		bc.PrintStatus("INFO: All AWX jobs completed successfully")
 	}
 
+	// the status has to be written before the host goes down
+	f.exit(run, nil)
+	Reboot(bc)
+
 	return nil
 }
 
-func internal(jobVars JobVars) (string, error) {
-	// kick off breakglass, wait until it finishes and check its status, and then kick off baseline
-	status, jobErr := KickoffJobs(fqdn, jobVars, foremanOptions.Mock)
+// exit prints the final status line and writes the status file, then exits with the
+// exit code of err. When the run was successful it returns so the host can be rebooted
+func (f *ForemanOptions) exit(run *RunStatus, err error) {
+	run.Finish(err)
+
+	fmt.Println(run.Line())
+	if writeErr := run.Write(f.StatusFile); writeErr != nil {
+		logger.Errorf("%v", writeErr)
+	}
+
+	if err != nil {
+		os.Exit(run.ExitCode)
+	}
+}
+
+func internal(bc *BuildContext) (string, error) {
+	// kick off each step, wait until it finishes and check its status, and then kick off the next one
+	status, jobErr := KickoffJobs(bc)
 	if jobErr != nil {
-		if strings.Contains(jobErr.Error(), "failed") {
-			return "", jobErr
-		}
-		if strings.Contains(jobErr.Error(), "(") {
-			return "", fmt.Errorf("internal(): %w", jobErr)
-		} else {
-			return "", jobErr
-		}
+		return "", Wrap("internal()", jobErr)
 	}
 
 	return status, nil
 }
 
-func client(jobVars JobVars) (string, error) {
+// how often client() asks the relay for the status of the build, and how many
+// times in a row it tolerates not being able to reach the relay
+const relayPollInterval = 15 * time.Second
+const relayPollRetries = 20
+
+func client(bc *BuildContext) (string, error) {
 	// add in the fqdn
-	jobVars.FQDN = fqdn
+	jobVars := bc.JobVars
+	jobVars.FQDN = bc.FQDN
 
-	if foremanOptions.Mock != "" {
-		jobVars.Mock = foremanOptions.Mock
+	// every request to the relay is signed with the key Foreman left next to the env file
+	key, err := ReadRelayKey()
+	if err != nil {
+		return "", Wrap("client()", err)
+	}
+
+	relay, err := NewRelayClient(jobVars.Relay, key, &foremanOptions.RelayOptions)
+	if err != nil {
+		return "", fmt.Errorf("client(): %w", err)
+	}
+
+	build, err := startRelayBuild(bc, relay, jobVars)
+	if err != nil {
+		return "", err
+	}
+
+	if foremanOptions.Follow {
+		stop := followBuild(bc, relay, build.ID)
+		build, err = pollBuild(bc, relay, build)
+		stop()
+	} else {
+		build, err = pollBuild(bc, relay, build)
+	}
+	if err != nil {
+		return "", fmt.Errorf("client(): %w", err)
+	}
+
+	PrintStepResults(bc, build.Steps)
+	bc.Run.SetSteps(build.Steps)
+
+	if build.Result == ResultSuccessful {
+		return "successful", nil
+	}
+	if build.Error == nil {
+		return "", &RelayError{Code: ErrCodeInternal, Message: fmt.Sprintf("the build finished with result %q", build.Result), Remediation: pteRemediation}
+	}
+
+	return "", build.Error
+}
+
+// PrintRelayError writes an error sent back by the relay to the build log
+func PrintRelayError(bc *BuildContext, relayErr *RelayError) {
+	bc.PrintStatus(fmt.Sprintf("ERROR: the AWX Relay reported %v: %v", relayErr.Code, relayErr.Message))
+	bc.PrintStatus(fmt.Sprintf("INFO: %v", relayErr.Remediation))
+}
+
+// startRelayBuild sends the build to the relay, unless the relay is still running
+// the build this host sent before it was rebooted, in which case that one is followed
+func startRelayBuild(bc *BuildContext, relay *RelayClient, jobVars JobVars) (BuildStatus, error) {
+	if buildID := bc.State.RelayBuildID(); buildID != "" {
+		// a cancelled build is over, the host gets a new one
+		if build, err := getBuildStatus(relay, buildID); err == nil && build.Result != ResultCancelled {
+			bc.PrintStatus(fmt.Sprintf("INFO: Reattaching to build %v on the AWX Relay", build.ID))
+			bc.Run.SetBuildID(build.ID)
+			return build, nil
+		}
 	}
 
 	// encode our object in JSON which can then be sent to the relay
 	jsonData, jsonErr := json.Marshal(jobVars)
 	if jsonErr != nil {
-		return "", fmt.Errorf("client(): json.Marshal(): %w", jsonErr)
+		return BuildStatus{}, fmt.Errorf("startRelayBuild(): json.Marshal(): %w", jsonErr)
 	}
 
-	PrintStatus("INFO: Sending collected data to the AWX Relay...")
-	mtrelayHostURL := fmt.Sprintf("http://%v:%v/build", jobVars.Relay, foremanOptions.RelayPort)
-	requestData, requestErr := http.NewRequest(http.MethodPost, mtrelayHostURL, bytes.NewReader(jsonData))
+	bc.PrintStatus("INFO: Sending collected data to the AWX Relay...")
+	r, respBody, err := relay.Do(http.MethodPost, "/build/", jsonData)
+	if err != nil {
+		return BuildStatus{}, fmt.Errorf("startRelayBuild(): %w", err)
+	}
 
-	if requestErr != nil {
-		return "", fmt.Errorf("client(): http.NewRequest(): %w", requestErr)
+	if r.StatusCode != http.StatusAccepted {
+		return BuildStatus{}, relayErrorFromBody(r.Status, respBody)
 	}
 
-	r, err := http.DefaultClient.Do(requestData)
-	if err != nil {
-		return "", fmt.Errorf("client(): http.DefaultClient(): %w", err)
+	var build BuildStatus
+	if err := json.Unmarshal(respBody, &build); err != nil {
+		return build, fmt.Errorf("startRelayBuild(): json.Unmarshal(): %w", err)
 	}
 
-	respBody, err := io.ReadAll(r.Body)
-	if err != nil {
-		return "", fmt.Errorf("client() io.ReadAll(): %w", err)
+	bc.PrintStatus(fmt.Sprintf("INFO: The AWX Relay accepted the build, build ID is %v", build.ID))
+	bc.CheckState(bc.State.SetBuildID(build.ID))
+	bc.Run.SetBuildID(build.ID)
+	bc.CheckState(bc.State.SetPhase(build.Phase))
+
+	return build, nil
+}
+
+// pollBuild checks the status of a build on the relay until it has finished
+func pollBuild(bc *BuildContext, relay *RelayClient, build BuildStatus) (BuildStatus, error) {
+	var failures int
+
+	for build.Phase != PhaseFinished {
+		time.Sleep(relayPollInterval)
+
+		current, err := getBuildStatus(relay, build.ID)
+		if err != nil {
+			failures++
+			if failures >= relayPollRetries {
+				return build, fmt.Errorf("pollBuild(): giving up after %v attempts: %w", failures, err)
+			}
+			bc.PrintStatus(fmt.Sprintf("INFO: Couldn't get the build status from the AWX Relay, trying again: %v", err))
+			continue
+		}
+		failures = 0
+
+		// only report what the relay is doing when it changes
+		if current.Step != build.Step || current.JobID != build.JobID {
+			if current.Step != "" && current.JobID != 0 {
+				bc.PrintStatus(fmt.Sprintf("INFO: AWX Relay is running %v, job id %v", current.Step, current.JobID))
+			}
+		}
+		build = current
 	}
 
-	pteErrorMsg := "There is an issue with the AWX Relay, please reach out to Platform Engineering.\n "
+	return build, nil
+}
 
-	if r.StatusCode == 500 {
-		return "", fmt.Errorf(pteErrorMsg + strings.Trim(string(respBody), "\""))
+// how long followBuild waits for the rest of the log once the build has finished
+const followDrainTimeout = 5 * time.Second
+
+// followBuild mirrors the log of a build on the relay to the console until the build finishes or stop is called.
+// The stream is reconnected when it drops, picking up after the last event that was received
+func followBuild(bc *BuildContext, relay *RelayClient, buildID string) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		var last int
+		var finished bool
+		for {
+			err := relay.Events(ctx, buildID, last, func(event BuildEvent) {
+				last = event.ID
+				switch event.Type {
+				case EventLog:
+					level, _ := ParseLevel(event.Level)
+					logger.Log(level, "relay: "+event.Message, bc.LogFields())
+				case EventFinished:
+					finished = true
+				}
+			})
+			if finished || ctx.Err() != nil {
+				return
+			}
+
+			// the relay answered but won't stream the build, ex. it's an older version
+			var relayErr *RelayError
+			if errors.As(err, &relayErr) {
+				bc.PrintStatus(fmt.Sprintf("WARN: Can't follow the log of the build on the AWX Relay, only reporting its progress: %v", relayErr.Message))
+				return
+			}
+			if err != nil {
+				logger.Log(LevelDebug, fmt.Sprintf("the log stream of the AWX Relay dropped, reconnecting: %v", err), bc.LogFields())
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(relayPollInterval):
+			}
+		}
+	}()
+
+	return func() {
+		select {
+		case <-done:
+		case <-time.After(followDrainTimeout):
+		}
+		cancel()
+		<-done
 	}
+}
+
+// getBuildStatus fetches the status of a single build from the relay
+func getBuildStatus(relay *RelayClient, buildID string) (BuildStatus, error) {
+	var build BuildStatus
 
-	if r.StatusCode == 401 {
-		errMsg := "Access Denied: Ensure the correct credentials are in /var/tmp/.tower-creds and the Foreman user has access to %v in AWX"
-		newErrMsg := fmt.Sprintf("%v%v", pteErrorMsg, errMsg)
-		return "", fmt.Errorf(newErrMsg)
+	r, respBody, err := relay.Do(http.MethodGet, "/build/"+buildID, nil)
+	if err != nil {
+		return build, fmt.Errorf("getBuildStatus(): %w", err)
 	}
 
-	if strings.Trim(string(respBody), "\"") == "successful" {
-		return "successful", nil
-	} else {
-		return "", requestErr
+	if r.StatusCode != http.StatusOK {
+		return build, fmt.Errorf("getBuildStatus(): %w", relayErrorFromBody(r.Status, respBody))
+	}
+
+	if err := json.Unmarshal(respBody, &build); err != nil {
+		return build, fmt.Errorf("getBuildStatus(): json.Unmarshal(): %w", err)
 	}
+
+	return build, nil
 }
 
 // Prelaunch does all the "pre-flight" checks necessary in order to kick off the ansible jobs
@@ -183,17 +391,14 @@ func Prelaunch(fqdn string) (JobVars, error) {
 
 	// make sure the network is connected
 	if err := CheckConnectivity(); err != nil {
-		return jobVars, fmt.Errorf("prelaunch(): %w", err)
+		return jobVars, Wrap("prelaunch()", err)
 	}
 
 	// read the env vars left by Foreman, read the AWX vars file on osmedia based on the distro and host environment
 	// and based on those create and return an object with all the necessary info
-	jobVars, jobErr := ReadAwxVars()
+	jobVars, jobErr := ReadAwxVars(fqdn)
 	if jobErr != nil {
-		if strings.Contains(jobErr.Error(), "404") {
-			return jobVars, jobErr
-		}
-		return jobVars, fmt.Errorf("prelaunch(): %w", jobErr)
+		return jobVars, Wrap("prelaunch()", jobErr)
 	}
 
 	// make the systemd journal persist after a reboot so we can check the final status
@@ -205,24 +410,21 @@ func Prelaunch(fqdn string) (JobVars, error) {
 	// is the FQDN resolvable?
 	if err := DnsLookup(fqdn, foremanOptions.Mock); err != nil {
 		//not a program issue, IP doesn't resolve correctly
-		if strings.Contains(err.Error(), "DDNS") {
-			return jobVars, err
-		}
-		return jobVars, fmt.Errorf("prelaunch(): %w", err)
+		return jobVars, Wrap("prelaunch()", err)
 	}
 
 	return jobVars, nil
 }
 
 // ReadAwxVars reads the AWX job template names and IDs from a JSON formatted text file
-func ReadAwxVars() (JobVars, error) {
+func ReadAwxVars(fqdn string) (JobVars, error) {
 	var jobVars JobVars
 	var awxVarsResp *http.Response
 
 	// reading our env vars set by Foreman
 	foremanVars, err := ReadForemanVars()
 	if err != nil {
-		return jobVars, fmt.Errorf("getJobVars(): %w", err)
+		return jobVars, Wrap("ReadAwxVars()", err)
 	}
 
 	distro, err := CheckDistro()
@@ -252,41 +454,53 @@ func ReadAwxVars() (JobVars, error) {
 	if strings.Contains(foremanOptions.File, "http") || foremanOptions.File == "" {
 		awxVarsResp, err = http.Get(awxVarsLocation)
 		if err != nil {
-			return jobVars, fmt.Errorf("ReadAwxVars(): http.Get(): %w", err)
+			return jobVars, &Error{Kind: ErrAwxVars, Err: fmt.Errorf("ReadAwxVars(): http.Get(): %w", err)}
 		} else if awxVarsResp.StatusCode == 404 {
-			return jobVars, fmt.Errorf("ERROR: 404: can't find %v", awxVarsLocation)
+			return jobVars, NewError(ErrAwxVars, "can't find %v (404)", awxVarsLocation)
 		} else if awxVarsResp.StatusCode != 200 {
-			return jobVars, fmt.Errorf("ERROR: ReadAwxVars(): http.Get(): %v", awxVarsResp.Status)
+			return jobVars, NewError(ErrAwxVars, "can't fetch %v: %v", awxVarsLocation, awxVarsResp.Status)
 		}
 		awxVarsBody, err := io.ReadAll(awxVarsResp.Body)
 		if err != nil {
-			return jobVars, fmt.Errorf("client() io.ReadAll(): %w", err)
+			return jobVars, &Error{Kind: ErrAwxVars, Err: fmt.Errorf("ReadAwxVars(): io.ReadAll(): %w", err)}
 		}
 
 		if jsonErr := json.Unmarshal(awxVarsBody, &awxVars); jsonErr != nil {
-			return jobVars, fmt.Errorf("client(): json.Unmarshal(): %w", err)
+			return jobVars, NewError(ErrAwxVars, "%v isn't valid JSON: %v", awxVarsLocation, jsonErr)
 		}
 	} else if foremanOptions.File != "" {
 		data, err := os.ReadFile(foremanOptions.File)
 		if err != nil {
-			return jobVars, fmt.Errorf("ReadAwxVars(): os.ReadFile(): %w", err)
+			return jobVars, &Error{Kind: ErrAwxVars, Err: fmt.Errorf("ReadAwxVars(): os.ReadFile(): %w", err)}
+		}
+		if err := json.Unmarshal(data, &awxVars); err != nil {
+			return jobVars, NewError(ErrAwxVars, "%v isn't valid JSON: %v", foremanOptions.File, err)
 		}
-		json.Unmarshal(data, &awxVars)
 	} else {
 		return jobVars, fmt.Errorf("ReadAwxVars(): can't find awxvars")
 	}
 
-	jobVars.InvID = awxVars.InventoryID
+	if awxVars.InventoryName == "" {
+		return jobVars, NewError(ErrConfig, "the awxvars file needs inventoryname to be set")
+	}
+	if err := awxVars.Poll.Validate(); err != nil {
+		return jobVars, NewError(ErrConfig, "the awxvars file is invalid: %v", err)
+	}
+	for i := range awxVars.Steps {
+		awxVars.Steps[i].Poll = awxVars.Steps[i].Poll.Or(awxVars.Poll)
+	}
+	if err := ValidateSteps(awxVars.Steps); err != nil {
+		return jobVars, NewError(ErrConfig, "the awxvars file is invalid: %v", err)
+	}
+
 	jobVars.InvName = awxVars.InventoryName
 	jobVars.Reboot = awxVars.Reboot
-	jobVars.BreakglassName = awxVars.BreakglassName
-	jobVars.BreakglassID = awxVars.BreakglassID
-	jobVars.BaselineName = awxVars.BaselineName
-	jobVars.BaselineID = awxVars.BaselineID
+	jobVars.Steps = awxVars.Steps
 	jobVars.DesiredRelease = fmt.Sprintf("%v.%v", foremanVars.OSmajor, foremanVars.OSminor)
 	jobVars.FQDN = fqdn
 	jobVars.Type = foremanVars.Type
 	jobVars.Facility = foremanVars.Facility
+	jobVars.Distro = distro
 	jobVars.Relay = foremanVars.Relay
 
 	return jobVars, nil
@@ -296,14 +510,13 @@ func ReadAwxVars() (JobVars, error) {
 func CheckConnectivity() error {
 	pinger, err := ping.NewPinger("osmedia.bamtech.co")
 	if err != nil {
-		return fmt.Errorf("checkConnectivity(): ping.NewPinger(): %w", err)
+		return &Error{Kind: ErrNetwork, Err: fmt.Errorf("checkConnectivity(): ping.NewPinger(): %w", err)}
 	}
 	pinger.Count = 3
 	pinger.Run()                 // blocks until finished
 	stats := pinger.Statistics() // get send/receive/rtt stats
 	if stats.PacketLoss > 10 {
-		err := errors.New("error: high packet loss, check network connnectivity")
-		return fmt.Errorf("checkConnectivity(): pinger.Statistics(): %w", err)
+		return NewError(ErrNetwork, "high packet loss to %v, check network connectivity", pinger.Addr())
 	}
 	return nil
 }
@@ -338,7 +551,7 @@ func DnsLookup(fqdn, mock string) error {
 
 	foremanVars, err := ReadForemanVars()
 	if err != nil {
-		return fmt.Errorf("dnsLookup(): %w", err)
+		return Wrap("dnsLookup()", err)
 	}
 
 	ips, err := net.LookupIP(fqdn)
@@ -353,15 +566,13 @@ func DnsLookup(fqdn, mock string) error {
 	}
 
 	//IP doesn't resolve correctly
-	msg1 := "DNS A record and IP set by Foreman don't match, ensure host was registered using the DDNS tool"
-	return fmt.Errorf(msg1)
+	return NewError(ErrDNSMismatch, "DNS A record and IP set by Foreman don't match, ensure host was registered using the DDNS tool")
 
 }
 
-// ReadForemanVars reads the environment file in /etc left by Foreman after a successful provisioning
-func ReadForemanVars() (ForemanVars, error) {
+// ForemanEnvFile returns the path of the environment file left by Foreman
+func ForemanEnvFile() (string, error) {
 	var envFile string
-	var foremanVars ForemanVars
 
 	// check which env file exists if any
 	if _, err := os.Stat("/etc/dss.env"); !errors.Is(err, os.ErrNotExist) {
@@ -371,14 +582,25 @@ func ReadForemanVars() (ForemanVars, error) {
 		envFile = "/etc/bam.env"
 	}
 	if envFile == "" {
-		err := fmt.Errorf("readForemanVars(): can't find environment file containing Foreman variables")
-		return foremanVars, err
+		return "", NewError(ErrEnvFile, "can't find /etc/bam.env or /etc/dss.env, the environment file containing Foreman variables")
+	}
+
+	return envFile, nil
+}
+
+// ReadForemanVars reads the environment file in /etc left by Foreman after a successful provisioning
+func ReadForemanVars() (ForemanVars, error) {
+	var foremanVars ForemanVars
+
+	envFile, err := ForemanEnvFile()
+	if err != nil {
+		return foremanVars, Wrap("readForemanVars()", err)
 	}
 
 	// read the file
 	vars, err := ReadFile(envFile)
 	if err != nil {
-		return foremanVars, fmt.Errorf("ReadForemanVars(): %w", err)
+		return foremanVars, &Error{Kind: ErrEnvFile, Err: fmt.Errorf("ReadForemanVars(): %w", err)}
 	}
 
 	for key, value := range vars {
@@ -401,86 +623,104 @@ func ReadForemanVars() (ForemanVars, error) {
 	}
 
 	if foremanVars.Server == "" {
-		return foremanVars, fmt.Errorf("ReadForemanVars(): foremanVars.Server key is empty. Ensure %v contains the correct data", envFile)
+		return foremanVars, NewError(ErrEnvFile, "the build_server key is empty. Ensure %v contains the correct data", envFile)
 	} else if foremanVars.Facility == "" {
-		return foremanVars, fmt.Errorf("ReadForemanVars(): foremanVars.Facility key is empty. Ensure %v contains the correct data", envFile)
+		return foremanVars, NewError(ErrEnvFile, "the facility key is empty. Ensure %v contains the correct data", envFile)
 	} else if foremanVars.Type == "" {
-		return foremanVars, fmt.Errorf("ReadForemanVars(): foremanVars.Type key is empty. Ensure %v contains the correct data", envFile)
+		return foremanVars, NewError(ErrEnvFile, "the type key is empty. Ensure %v contains the correct data", envFile)
 	} else if foremanVars.BuildIP == "" {
-		return foremanVars, fmt.Errorf("ReadForemanVars(): foremanVars.BuildIP key is empty. Ensure %v contains the correct data", envFile)
+		return foremanVars, NewError(ErrEnvFile, "the buildip key is empty. Ensure %v contains the correct data", envFile)
 	} else if foremanVars.OSmajor == "" {
-		return foremanVars, fmt.Errorf("ReadForemanVars(): foremanVars.OSmajor key is empty. Ensure %v contains the correct data", envFile)
+		return foremanVars, NewError(ErrEnvFile, "the osmajor key is empty. Ensure %v contains the correct data", envFile)
 	} else if foremanVars.OSminor == "" {
-		return foremanVars, fmt.Errorf("ReadForemanVars(): foremanVars.OSminor key is empty. Ensure %v contains the correct data", envFile)
+		return foremanVars, NewError(ErrEnvFile, "the osminor key is empty. Ensure %v contains the correct data", envFile)
 	}
 
 	return foremanVars, nil
 }
 
-// KickoffJobs launches breakglass and baseline apply
-func KickoffJobs(fqdn string, jobVars JobVars, mock string) (string, error) {
+// KickoffJobs launches the pipeline of job templates listed in the awxvars file, ex. breakglass and baseline apply
+func KickoffJobs(bc *BuildContext) (string, error) {
 	var err error
 
-	if awx, err = AwxClientSetup(); err != nil {
-		return "", err
+	if bc.AWX, err = AwxClientSetup(bc.Context(), bc.AwxConfig); err != nil {
+		return "", bc.CancelledOr(err)
+	}
+	if bc.AwxConfig.Insecure {
+		bc.PrintStatus(fmt.Sprintf("INFO: Not verifying the certificate of %v", bc.AwxConfig.URL))
+	}
+
+	// the awxvars file only contains names, look up their IDs before doing anything else
+	if err := ResolveJobVars(bc); err != nil {
+		return "", Wrap("kickoffJobs()", bc.CancelledOr(err))
 	}
+	jobVars := bc.JobVars
 
 	// hack to make sure our host exists in the required inventory
-	if err := DoesHostExist(fqdn, jobVars); err != nil {
-		if strings.Contains(err.Error(), "ERROR") {
-			return "", err
-		}
-		return "", fmt.Errorf("kickoffJobs(): %w", err)
+	bc.SetPhase(PhaseInventory, "")
+	if err := DoesHostExist(bc); err != nil {
+		return "", Wrap("kickoffJobs()", bc.CancelledOr(err))
+	}
+	if err := bc.Cancelled(); err != nil {
+		return "", err
 	}
 
 	// skip launching jobs in order to test other functions quickly
-	if mock != "" {
-		PrintStatus(fmt.Sprintf("INFO: Kicking off %v...", jobVars.BaselineName))
-		PrintStatus(fmt.Sprintf("INFO: Kicking off %v...", jobVars.BreakglassName))
-		return "successful", nil
-	} else {
-		// kicking off breakglass
-		breakglassParams := map[string]interface{}{"inventory": jobVars.InvID, "limit": jobVars.FQDN}
-		err := LaunchJob(fqdn, jobVars.BreakglassName, jobVars.BreakglassID, breakglassParams)
-		if err != nil {
-			if strings.Contains(err.Error(), "failed") {
-				return "", err
-			}
-			return "", fmt.Errorf("KickoffJobs(): %w", err)
+	if jobVars.Mock != "" {
+		for _, step := range jobVars.Steps {
+			bc.PrintStatus(fmt.Sprintf("INFO: Kicking off %v...", step.Name))
 		}
+		return "successful", nil
+	}
 
-		// kicking off baseline
-		baselineParams := map[string]interface{}{"inventory": jobVars.InvID, "limit": jobVars.FQDN,
-			"extra_vars": fmt.Sprintf("{desired_release: %v, reboot: false}", jobVars.DesiredRelease),
-		}
-		err = LaunchJob(fqdn, jobVars.BaselineName, jobVars.BaselineID, baselineParams)
-		if err != nil {
-			if strings.Contains(err.Error(), "failed") {
-				return "", err
-			}
-			return "", fmt.Errorf("KickoffJobs(): %w", err)
-		}
+	// launch every step in the awxvars file in order
+	results, err := RunPipeline(bc)
+	PrintStepResults(bc, results)
+	bc.Run.SetSteps(results)
+	if err != nil {
+		return "", Wrap("KickoffJobs()", bc.CancelledOr(err))
 	}
+
 	return "successful", nil
 }
 
 // CleanUp removes the AWX credentials file, disables the awxclient systemd unit, and optionally reboots the host upon completion
-func CleanUp(reboot, mock string) error {
-	PrintStatus("INFO: Cleaning up...")
+func CleanUp(bc *BuildContext) error {
+	bc.PrintStatus("INFO: Cleaning up...")
+
+	// the AWX token created for this build is no longer needed, even when mocking
+	if err := bc.AWX.RevokeToken(); err != nil {
+		return fmt.Errorf("CleanUp(): %w", err)
+	}
 
 	// if we're mocking a job launch, don't clean up because we're testing stuff
-	if mock != "" {
-		PrintStatus("INFO: Build completed successfully. Please manually reboot.")
-		os.Exit(0)
+	if bc.JobVars.Mock != "" {
+		return nil
+	}
+
+	// credentials that were only meant for this build, ex. written by Foreman, are removed
+	if bc.AwxConfig.Credentials != nil {
+		if err := bc.AwxConfig.Credentials.Remove(); err != nil {
+			return fmt.Errorf("CleanUp(): %w", err)
+		}
 	}
 
-	// if /var/tmp/.tower_creds exists, remove it
+	// if /var/tmp/.tower_creds exists, remove it, Foreman writes it even on hosts that leave AWX to the relay
 	if _, err := os.Stat("/var/tmp/.tower_creds"); err == nil {
 		if err := os.Remove("/var/tmp/.tower_creds"); err != nil {
 			return fmt.Errorf("CleanUp(): os.Remove(): %w", err)
 		}
 	}
 
+	// the relay key is only needed for the build, same as the AWX credentials
+	if envFile, err := ForemanEnvFile(); err == nil {
+		if _, err := os.Stat(RelayKeyFile(envFile)); err == nil {
+			if err := os.Remove(RelayKeyFile(envFile)); err != nil {
+				return fmt.Errorf("CleanUp(): os.Remove(): %w", err)
+			}
+		}
+	}
+
 	// figuring out which unit is enabled
 	unitfile, err := filepath.Glob("/etc/systemd/system/multi-user.target.wants/awxclient*")
 	if err != nil {
@@ -501,14 +741,17 @@ func CleanUp(reboot, mock string) error {
 		return fmt.Errorf("CleanUp(): exec.Command().Output(): %w", err)
 	}
 
-	if reboot == "true" {
-		PrintStatus("INFO: Build completed successfully. Rebooting in 60 seconds.")
+	return nil
+}
+
+// Reboot reboots the host once the build completed if the awxvars file asks for it, never when mocking
+func Reboot(bc *BuildContext) {
+	if bc.JobVars.Reboot == "true" && bc.JobVars.Mock == "" {
+		bc.PrintStatus("INFO: Build completed successfully. Rebooting in 60 seconds.")
 		time.Sleep(1 * time.Minute)
 		syscall.Sync()
 		syscall.Reboot(syscall.LINUX_REBOOT_CMD_RESTART)
 	} else {
-		PrintStatus("INFO: Build completed successfully. Please manually reboot.")
+		bc.PrintStatus("INFO: Build completed successfully. Please manually reboot.")
 	}
-
-	return nil
 }
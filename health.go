@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// how long the result of the readiness checks is reused, so load balancers polling
+// /readyz don't turn into a steady stream of logins to AWX
+const readyCacheTTL = 30 * time.Second
+
+// HealthCheck is the outcome of a single readiness check
+type HealthCheck struct {
+	Name     string `json:"name"`
+	OK       bool   `json:"ok"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+// HealthStatus is the body of /healthz and /readyz
+type HealthStatus struct {
+	Status  string        `json:"status"` // ok or failing
+	Checks  []HealthCheck `json:"checks,omitempty"`
+	Checked string        `json:"checked,omitempty"`
+}
+
+// readiness runs the readiness checks of the relay and remembers the result for a while
+type readiness struct {
+	mu      sync.Mutex
+	relay   *RelayCommand
+	status  HealthStatus
+	checked time.Time
+}
+
+// healthz only says the process is alive and serving requests
+func healthz(c *gin.Context) {
+	c.JSON(http.StatusOK, HealthStatus{Status: "ok"})
+}
+
+// readyz says whether the relay can actually build hosts
+func (r *readiness) readyz(c *gin.Context) {
+	status := r.check()
+	if status.Status != "ok" {
+		c.JSON(http.StatusServiceUnavailable, status)
+		return
+	}
+	c.JSON(http.StatusOK, status)
+}
+
+func (r *readiness) check() HealthStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if time.Since(r.checked) < readyCacheTTL {
+		return r.status
+	}
+
+	checks := []struct {
+		name  string
+		check func() error
+	}{
+		{"config", r.relay.checkConfig},
+		{"awx", r.relay.checkAwx},
+		{"logdir", func() error { return checkWritable(r.relay.LogDir) }},
+		{"statedir", func() error { return checkWritable(r.relay.StateDir) }},
+	}
+
+	status := HealthStatus{Status: "ok"}
+	for _, check := range checks {
+		started := time.Now()
+		result := HealthCheck{Name: check.name, OK: true}
+		if err := check.check(); err != nil {
+			result.OK = false
+			result.Error = err.Error()
+			status.Status = "failing"
+		}
+		result.Duration = time.Since(started).Round(time.Millisecond).String()
+		status.Checks = append(status.Checks, result)
+	}
+
+	r.checked = time.Now()
+	status.Checked = r.checked.Format(time.RFC3339)
+	r.status = status
+
+	return status
+}
+
+// checkConfig ensures the configuration the builds need was loaded
+func (r *RelayCommand) checkConfig() error {
+	if r.inventories == nil {
+		return fmt.Errorf("the inventory mapping isn't loaded")
+	}
+	if r.awxConfig.URL == "" {
+		return fmt.Errorf("the AWX URL isn't set")
+	}
+	return nil
+}
+
+// checkAwx logs in to AWX the same way a build does, which proves AWX can be reached and the credentials are valid
+func (r *RelayCommand) checkAwx() error {
+	// the result is shared by every probe, so it isn't tied to the request of one of them
+	ctx := context.Background()
+	awx, err := AwxClientSetup(ctx, r.awxConfig)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := awx.RevokeToken(); err != nil {
+			logger.Errorf("%v", err)
+		}
+	}()
+
+	var me struct {
+		Results []struct {
+			Username string `json:"username"`
+		} `json:"results"`
+	}
+	if err := awx.GetJSON(ctx, "/api/v2/me/", nil, &me); err != nil {
+		return err
+	}
+	if len(me.Results) == 0 {
+		return NewError(ErrAuthDenied, "AWX doesn't know who the credentials of the relay belong to")
+	}
+
+	return nil
+}
+
+// checkWritable ensures files can be created in dir
+func checkWritable(dir string) error {
+	if err := os.MkdirAll(dir, 0775); err != nil {
+		return fmt.Errorf("checkWritable(): os.MkdirAll(): %w", err)
+	}
+
+	f, err := os.CreateTemp(dir, ".readyz-*")
+	if err != nil {
+		return fmt.Errorf("checkWritable(): os.CreateTemp(): %w", err)
+	}
+	f.Close()
+
+	if err := os.Remove(f.Name()); err != nil {
+		return fmt.Errorf("checkWritable(): os.Remove(): %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// InventoryMapping maps a host type, distro and major release to the AWX inventory
+// the host belongs in, and to the name of the group it's added to in that inventory
+type InventoryMapping struct {
+	Type          string `json:"type"`
+	Distro        string `json:"distro"` // empty matches every distro
+	Major         string `json:"major"`  // empty matches every major release
+	InventoryName string `json:"inventoryname"`
+	InventoryID   int    `json:"-"`     // looked up in AWX from InventoryName
+	Group         string `json:"group"` // ex. "{facility}", see groupPlaceholders
+}
+
+// InventoryMap is the list of mappings read from the inventory mapping file
+type InventoryMap struct {
+	Inventories []InventoryMapping `json:"inventories"`
+	path        string
+}
+
+// the placeholders that can be used in the group naming rule of a mapping
+var groupPlaceholders = []string{"{facility}", "{type}", "{distro}", "{major}"}
+
+// LoadInventoryMap reads the inventory mapping file and validates it
+func LoadInventoryMap(path string) (*InventoryMap, error) {
+	inventoryMap := &InventoryMap{path: path}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("LoadInventoryMap(): os.ReadFile(): %w", err)
+	}
+
+	if err := json.Unmarshal(data, inventoryMap); err != nil {
+		return nil, fmt.Errorf("LoadInventoryMap(): json.Unmarshal(): %v: %w", path, err)
+	}
+
+	if err := inventoryMap.Validate(); err != nil {
+		return nil, fmt.Errorf("LoadInventoryMap(): %v: %w", path, err)
+	}
+
+	return inventoryMap, nil
+}
+
+// Validate ensures every mapping is complete and that no two mappings match the same hosts
+func (m *InventoryMap) Validate() error {
+	if len(m.Inventories) == 0 {
+		return fmt.Errorf("no inventories are defined")
+	}
+
+	unknownPlaceholder := regexp.MustCompile(`{[^}]*}`)
+	seen := make(map[string]bool)
+
+	for i, mapping := range m.Inventories {
+		switch {
+		case mapping.Type == "":
+			return fmt.Errorf("inventory mapping %v: type is empty", i)
+		case mapping.InventoryName == "":
+			return fmt.Errorf("inventory mapping %v: inventoryname is empty", i)
+		case mapping.Group == "":
+			return fmt.Errorf("inventory mapping %v: group is empty", i)
+		}
+
+		// anything left in braces after removing the known placeholders is a typo
+		group := mapping.Group
+		for _, placeholder := range groupPlaceholders {
+			group = strings.ReplaceAll(group, placeholder, "")
+		}
+		if unknown := unknownPlaceholder.FindString(group); unknown != "" {
+			return fmt.Errorf("inventory mapping %v: unknown placeholder %v in group %v", i, unknown, mapping.Group)
+		}
+
+		key := mapping.String()
+		if seen[key] {
+			return fmt.Errorf("inventory mapping %v: %v is defined more than once", i, key)
+		}
+		seen[key] = true
+	}
+
+	return nil
+}
+
+// Lookup returns the most specific mapping matching the type, distro and major release of a host
+func (m *InventoryMap) Lookup(jobVars JobVars) (InventoryMapping, error) {
+	var match InventoryMapping
+	bestScore := -1
+	major := MajorRelease(jobVars.DesiredRelease)
+
+	for _, mapping := range m.Inventories {
+		if mapping.Type != jobVars.Type {
+			continue
+		}
+		if mapping.Distro != "" && mapping.Distro != jobVars.Distro {
+			continue
+		}
+		if mapping.Major != "" && mapping.Major != major {
+			continue
+		}
+
+		// a mapping naming the distro or release wins over one that matches all of them
+		score := 0
+		if mapping.Distro != "" {
+			score++
+		}
+		if mapping.Major != "" {
+			score++
+		}
+		if score > bestScore {
+			match, bestScore = mapping, score
+		}
+	}
+
+	if bestScore < 0 {
+		return match, NewError(ErrConfig, "there is no inventory mapping for type %v, distro %v, release %v in %v",
+			jobVars.Type, jobVars.Distro, major, m.path)
+	}
+
+	return match, nil
+}
+
+// GroupName applies the group naming rule of the mapping to a host
+func (i InventoryMapping) GroupName(jobVars JobVars) string {
+	replacer := strings.NewReplacer(
+		"{facility}", jobVars.Facility,
+		"{type}", jobVars.Type,
+		"{distro}", jobVars.Distro,
+		"{major}", MajorRelease(jobVars.DesiredRelease),
+	)
+	return replacer.Replace(i.Group)
+}
+
+// String describes which hosts the mapping matches
+func (i InventoryMapping) String() string {
+	distro, major := i.Distro, i.Major
+	if distro == "" {
+		distro = "any"
+	}
+	if major == "" {
+		major = "any"
+	}
+	return fmt.Sprintf("type %v, distro %v, release %v", i.Type, distro, major)
+}
+
+// MajorRelease returns the major version of a release, ex. 8 for 8.6
+func MajorRelease(release string) string {
+	return strings.SplitN(release, ".", 2)[0]
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestInventoryMapValidate(t *testing.T) {
+	tests := []struct {
+		name        string
+		inventories []InventoryMapping
+		err         string // empty when the map is valid
+	}{
+		{"valid", []InventoryMapping{
+			{Type: "midtier", InventoryName: "midtier", Group: "{facility}"},
+			{Type: "midtier", Distro: "rocky", Major: "8", InventoryName: "midtier-rocky8", Group: "{facility}-{distro}{major}"},
+			{Type: "edge", InventoryName: "edge", Group: "{type}_{facility}"},
+		}, ""},
+		{"static group", []InventoryMapping{{Type: "internal", InventoryName: "internal", Group: "internal"}}, ""},
+
+		{"no inventories", nil, "no inventories are defined"},
+		{"no type", []InventoryMapping{{InventoryName: "midtier", Group: "{facility}"}}, "type is empty"},
+		{"no inventory name", []InventoryMapping{{Type: "midtier", Group: "{facility}"}}, "inventoryname is empty"},
+		{"no group", []InventoryMapping{{Type: "midtier", InventoryName: "midtier"}}, "group is empty"},
+
+		{"unknown placeholder", []InventoryMapping{{Type: "midtier", InventoryName: "midtier", Group: "{site}"}}, "unknown placeholder {site}"},
+		{"unknown placeholder next to known ones", []InventoryMapping{
+			{Type: "midtier", InventoryName: "midtier", Group: "{facility}-{release}"},
+		}, "unknown placeholder {release}"},
+		{"placeholder in another case", []InventoryMapping{{Type: "midtier", InventoryName: "midtier", Group: "{Facility}"}}, "unknown placeholder {Facility}"},
+
+		{"same hosts twice", []InventoryMapping{
+			{Type: "midtier", Distro: "rocky", InventoryName: "midtier", Group: "{facility}"},
+			{Type: "midtier", Distro: "rocky", InventoryName: "midtier-other", Group: "other"},
+		}, "inventory mapping 1: type midtier, distro rocky, release any is defined more than once"},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			err := (&InventoryMap{Inventories: test.inventories}).Validate()
+			switch {
+			case test.err == "" && err != nil:
+				t.Fatalf("Validate() = %v, expected the map to be valid", err)
+			case test.err != "" && err == nil:
+				t.Fatalf("Validate() accepted the map, expected %q", test.err)
+			case test.err != "" && !strings.Contains(err.Error(), test.err):
+				t.Fatalf("Validate() = %v, expected %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestInventoryMapLookup(t *testing.T) {
+	// the least specific mapping comes first and last, the order they're listed in doesn't matter
+	inventoryMap := &InventoryMap{
+		path: "/etc/awxclient/inventories.json",
+		Inventories: []InventoryMapping{
+			{Type: "midtier", InventoryName: "midtier", Group: "{facility}"},
+			{Type: "midtier", Major: "9", InventoryName: "midtier-9", Group: "{facility}"},
+			{Type: "midtier", Distro: "rocky", Major: "8", InventoryName: "midtier-rocky8", Group: "{facility}_{distro}{major}"},
+			{Type: "midtier", Distro: "rocky", InventoryName: "midtier-rocky", Group: "{facility}"},
+			{Type: "edge", Distro: "ubuntu", InventoryName: "edge-ubuntu", Group: "{type}-{facility}"},
+			{Type: "edge", Distro: "ubuntu", Major: "22", InventoryName: "edge-ubuntu22", Group: "{type}-{facility}"},
+		},
+	}
+	if err := inventoryMap.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		jobVars JobVars
+		match   string // the name of the inventory, empty when no mapping matches
+		group   string
+	}{
+		{"distro and release", JobVars{Type: "midtier", Distro: "rocky", DesiredRelease: "8.6", Facility: "dc1"}, "midtier-rocky8", "dc1_rocky8"},
+		{"distro over any", JobVars{Type: "midtier", Distro: "rocky", DesiredRelease: "7.9", Facility: "dc1"}, "midtier-rocky", "dc1"},
+		{"release over any", JobVars{Type: "midtier", Distro: "alma", DesiredRelease: "9.2", Facility: "dc2"}, "midtier-9", "dc2"},
+		{"any", JobVars{Type: "midtier", Distro: "alma", DesiredRelease: "8.6", Facility: "dc2"}, "midtier", "dc2"},
+		{"release without a minor", JobVars{Type: "edge", Distro: "ubuntu", DesiredRelease: "22", Facility: "dc3"}, "edge-ubuntu22", "edge-dc3"},
+		{"other release of the distro", JobVars{Type: "edge", Distro: "ubuntu", DesiredRelease: "20.04", Facility: "dc3"}, "edge-ubuntu", "edge-dc3"},
+
+		{"unknown type", JobVars{Type: "internal", Distro: "rocky", DesiredRelease: "8.6"}, "", ""},
+		{"distro without a mapping", JobVars{Type: "edge", Distro: "debian", DesiredRelease: "12"}, "", ""},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			mapping, err := inventoryMap.Lookup(test.jobVars)
+			if test.match == "" {
+				// the error names the mapping that's missing, and where it should be added
+				missing := "type " + test.jobVars.Type + ", distro " + test.jobVars.Distro + ", release " + MajorRelease(test.jobVars.DesiredRelease)
+				if !errors.Is(err, ErrConfig) || !strings.Contains(err.Error(), missing) || !strings.Contains(err.Error(), inventoryMap.path) {
+					t.Fatalf("Lookup() = %v, %v, expected an ErrConfig error naming %q in %v", mapping.InventoryName, err, missing, inventoryMap.path)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Lookup() = %v, expected %v", err, test.match)
+			}
+			if mapping.InventoryName != test.match {
+				t.Errorf("Lookup() = %v (%v), expected %v", mapping.InventoryName, mapping, test.match)
+			}
+			if group := mapping.GroupName(test.jobVars); group != test.group {
+				t.Errorf("GroupName() = %v, expected %v", group, test.group)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	awxGo "github.com/Colstuwjx/awx-go"
+)
+
+// AwxJob is the part of an AWX job we care about, the status of the job as a whole
+type AwxJob struct {
+	ID             int    `json:"id"`
+	Name           string `json:"name"`
+	Status         string `json:"status"`
+	Failed         bool   `json:"failed"`
+	Limit          string `json:"limit"`
+	JobExplanation string `json:"job_explanation"` // why AWX couldn't run the job, ex. the project failed to update
+}
+
+// Running says whether the job hasn't finished yet
+func (j AwxJob) Running() bool {
+	switch j.Status {
+	case "new", "pending", "waiting", "running":
+		return true
+	default:
+		return false
+	}
+}
+
+// GetJob fetches the status of a job from AWX
+func GetJob(bc *BuildContext, jobID int) (AwxJob, error) {
+	var job AwxJob
+	if err := bc.AWX.GetJSON(bc.Context(), fmt.Sprintf("/api/v2/jobs/%v/", jobID), nil, &job); err != nil {
+		return job, fmt.Errorf("GetJob(): %w", err)
+	}
+	return job, nil
+}
+
+// GetHostSummary returns what a job did on host, or nil if the job didn't run against it
+func GetHostSummary(bc *BuildContext, jobID int, host string) (*awxGo.HostSummary, error) {
+	summaries, _, err := bc.AWX.JobService.GetHostSummaries(jobID, map[string]string{"host_name": host})
+	if err != nil {
+		return nil, fmt.Errorf("GetHostSummary(): awx.JobService.GetHostSummaries(): %w", err)
+	}
+
+	for i := range summaries {
+		if strings.EqualFold(summaries[i].HostName, host) {
+			return &summaries[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// JobOutcome works out whether a job that finished succeeded on host. The job as a whole has to
+// be successful, and host has to have been reached and run its tasks without any failing. host is
+// empty when the step runs against other hosts, in which case only the status of the job counts.
+// Unreachable hosts, hosts every task was skipped on, jobs cancelled in AWX and jobs AWX couldn't
+// run each fail with their own error
+func JobOutcome(job AwxJob, summary *awxGo.HostSummary, host string, events *JobEventStream) error {
+	switch job.Status {
+	case "successful":
+		if host == "" {
+			return nil
+		}
+	case "failed":
+	case "canceled":
+		return NewError(ErrCancelled, "%v (job id %v) was cancelled in AWX", job.Name, job.ID)
+	case "error":
+		explanation := job.JobExplanation
+		if explanation == "" {
+			explanation = "AWX didn't say why"
+		}
+		return &Error{Kind: ErrJobFailed, Err: NewError(ErrJobError, "AWX couldn't run %v (job id %v): %v", job.Name, job.ID, explanation)}
+	default:
+		return &Error{Kind: ErrJobFailed, Err: NewError(ErrJobError, "%v (job id %v) finished with the unknown status %q", job.Name, job.ID, job.Status)}
+	}
+
+	unreachable := events.Unreachable() || (summary != nil && summary.Dark > 0)
+	failure := events.Failure()
+	if failure == "" && unreachable {
+		failure = fmt.Sprintf("%v was unreachable", host)
+	}
+
+	switch {
+	case job.Status == "failed" || unreachable || (summary != nil && summary.Failures > 0):
+		if failure != "" {
+			return jobFailed(unreachable, "%v failed at %v, %v. Check job id %v for more info", job.Name, GetTime("short"), failure, job.ID)
+		}
+		return jobFailed(unreachable, "%v failed at %v. Check job id %v for more info", job.Name, GetTime("short"), job.ID)
+	case summary == nil:
+		return NewError(ErrJobFailed, "%v (job id %v) didn't run on %v, ensure the limit of the step and the inventory include it", job.Name, job.ID, host)
+	case summary.Ok == 0 && summary.Changed == 0 && summary.Skipped > 0:
+		return NewError(ErrSkippedAll, "every task of %v (job id %v) was skipped on %v, ensure the host matches the conditions of the playbook", job.Name, job.ID, host)
+	}
+
+	return nil
+}
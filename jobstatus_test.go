@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	awxGo "github.com/Colstuwjx/awx-go"
+)
+
+func TestJobOutcome(t *testing.T) {
+	const host = "web01.dc1.example.com"
+
+	// what the job did on the host
+	var (
+		notRun      *awxGo.HostSummary
+		ok          = &awxGo.HostSummary{HostName: host, Ok: 5, Skipped: 2}
+		changed     = &awxGo.HostSummary{HostName: host, Changed: 3, Skipped: 2}
+		skippedAll  = &awxGo.HostSummary{HostName: host, Skipped: 7}
+		failures    = &awxGo.HostSummary{HostName: host, Ok: 4, Failures: 1}
+		unreachable = &awxGo.HostSummary{HostName: host, Dark: 1}
+	)
+
+	tests := []struct {
+		name     string
+		status   string
+		summary  *awxGo.HostSummary
+		host     string
+		events   *JobEventStream
+		kind     error // nil when the job succeeded on the host
+		exitCode int
+	}{
+		{"successful, other hosts", "successful", notRun, "", nil, nil, ExitSuccess},
+		{"successful, ok", "successful", ok, host, nil, nil, ExitSuccess},
+		{"successful, changed", "successful", changed, host, nil, nil, ExitSuccess},
+		{"successful, not run", "successful", notRun, host, nil, ErrJobFailed, ExitJobFailed},
+		{"successful, skipped all", "successful", skippedAll, host, nil, ErrSkippedAll, ExitSkippedAll},
+		{"successful, failures", "successful", failures, host, nil, ErrJobFailed, ExitJobFailed},
+		{"successful, unreachable", "successful", unreachable, host, nil, ErrHostUnreachable, ExitJobFailed},
+		{"successful, unreachable event", "successful", ok, host, &JobEventStream{unreachable: true}, ErrHostUnreachable, ExitJobFailed},
+
+		{"failed, other hosts", "failed", notRun, "", nil, ErrJobFailed, ExitJobFailed},
+		{"failed, ok", "failed", ok, host, nil, ErrJobFailed, ExitJobFailed},
+		{"failed, not run", "failed", notRun, host, nil, ErrJobFailed, ExitJobFailed},
+		{"failed, skipped all", "failed", skippedAll, host, nil, ErrJobFailed, ExitJobFailed},
+		{"failed, failures", "failed", failures, host, &JobEventStream{failedTask: "install packages"}, ErrJobFailed, ExitJobFailed},
+		{"failed, unreachable", "failed", unreachable, host, nil, ErrHostUnreachable, ExitJobFailed},
+
+		{"canceled, other hosts", "canceled", notRun, "", nil, ErrCancelled, ExitCancelled},
+		{"canceled, ok", "canceled", ok, host, nil, ErrCancelled, ExitCancelled},
+		{"canceled, skipped all", "canceled", skippedAll, host, nil, ErrCancelled, ExitCancelled},
+
+		{"error, other hosts", "error", notRun, "", nil, ErrJobError, ExitJobFailed},
+		{"error, not run", "error", notRun, host, nil, ErrJobError, ExitJobFailed},
+		{"error, skipped all", "error", skippedAll, host, nil, ErrJobError, ExitJobFailed},
+
+		{"unknown status", "lost", ok, host, nil, ErrJobError, ExitJobFailed},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			events := test.events
+			if events == nil {
+				events = &JobEventStream{}
+			}
+
+			err := JobOutcome(AwxJob{ID: 12, Name: "baseline", Status: test.status}, test.summary, test.host, events)
+			switch {
+			case test.kind == nil && err != nil:
+				t.Fatalf("JobOutcome() = %v, expected the job to have succeeded", err)
+			case test.kind != nil && !errors.Is(err, test.kind):
+				t.Fatalf("JobOutcome() = %v, expected an error of kind %q", err, test.kind)
+			}
+			if code := ExitCode(err); code != test.exitCode {
+				t.Errorf("ExitCode(%v) = %v, expected %v", err, code, test.exitCode)
+			}
+
+			// a job that did nothing on the host is still a job that failed, but has its own code
+			if errors.Is(err, ErrSkippedAll) != (test.kind == ErrSkippedAll) {
+				t.Errorf("JobOutcome() = %v, only a job that skipped every task on the host is an ErrSkippedAll error", err)
+			}
+			if errors.Is(err, ErrSkippedAll) && (!errors.Is(err, ErrJobFailed) || ErrorCode(err) != ErrCodeSkippedAll) {
+				t.Errorf("JobOutcome() = %v with code %v, expected a failed job with code %v", err, ErrorCode(err), ErrCodeSkippedAll)
+			}
+		})
+	}
+}
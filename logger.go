@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is how important a log line is, lines below the level of the logger are dropped
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = map[Level]string{
+	LevelDebug: "DEBUG",
+	LevelInfo:  "INFO",
+	LevelWarn:  "WARN",
+	LevelError: "ERROR",
+}
+
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+// ParseLevel returns the level called name, ex. info or ERROR
+func ParseLevel(name string) (Level, error) {
+	for level, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return level, nil
+		}
+	}
+	return LevelInfo, NewError(ErrConfig, "unknown log level %q, it has to be debug, info, warn or error", name)
+}
+
+// splitLevel takes the INFO:, ERROR: etc. prefix off a message, messages without one are INFO
+func splitLevel(msg string) (Level, string) {
+	for level, levelName := range levelNames {
+		if strings.HasPrefix(msg, levelName+":") {
+			return level, strings.TrimSpace(strings.TrimPrefix(msg, levelName+":"))
+		}
+	}
+	if strings.HasPrefix(msg, "WARNING:") {
+		return LevelWarn, strings.TrimSpace(strings.TrimPrefix(msg, "WARNING:"))
+	}
+	return LevelInfo, msg
+}
+
+// LogFields say which build a log line belongs to, empty fields are left out
+type LogFields struct {
+	FQDN     string `json:"fqdn,omitempty"`
+	Facility string `json:"facility,omitempty"`
+	Type     string `json:"type,omitempty"`
+	BuildID  string `json:"buildid,omitempty"`
+	Step     string `json:"step,omitempty"`
+	JobID    int    `json:"jobid,omitempty"`
+}
+
+// text returns the fields as key=value pairs
+func (f LogFields) text() string {
+	var b strings.Builder
+	add := func(key, value string) {
+		if value == "" {
+			return
+		}
+		if strings.ContainsAny(value, " \"=") {
+			value = fmt.Sprintf("%q", value)
+		}
+		fmt.Fprintf(&b, " %v=%v", key, value)
+	}
+
+	add("fqdn", f.FQDN)
+	add("facility", f.Facility)
+	add("type", f.Type)
+	add("buildid", f.BuildID)
+	add("step", f.Step)
+	if f.JobID != 0 {
+		add("jobid", fmt.Sprint(f.JobID))
+	}
+
+	return b.String()
+}
+
+// the output formats of the logger
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// Logger writes leveled log lines as text for people or as JSON for the log pipeline
+type Logger struct {
+	mu     sync.Mutex
+	out    io.Writer
+	format string
+	level  Level
+}
+
+// logger is what everything that isn't the human-readable log of a build writes to
+var logger = NewLogger(os.Stdout, LogFormatText, LevelInfo)
+
+// NewLogger creates a logger writing lines of at least level to out
+func NewLogger(out io.Writer, format string, level Level) *Logger {
+	return &Logger{out: out, format: format, level: level}
+}
+
+// Log writes a single line along with the fields of the build it belongs to
+func (l *Logger) Log(level Level, msg string, fields LogFields) {
+	if level < l.level {
+		return
+	}
+	now := time.Now()
+
+	var line string
+	if l.format == LogFormatJSON {
+		data, err := json.Marshal(struct {
+			Time  string `json:"time"`
+			Level string `json:"level"`
+			Msg   string `json:"msg"`
+			LogFields
+		}{now.Format(time.RFC3339), strings.ToLower(level.String()), msg, fields})
+		if err != nil {
+			return
+		}
+		line = string(data)
+	} else {
+		line = fmt.Sprintf("%v %v: %v%v", now.Format(time.RFC3339), level, msg, fields.text())
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fmt.Fprintln(l.out, line)
+}
+
+// Print logs a message prefixed with INFO:, ERROR: etc. at that level
+func (l *Logger) Print(msg string, fields LogFields) {
+	level, text := splitLevel(strings.TrimSuffix(msg, "\n"))
+	l.Log(level, text, fields)
+}
+
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.Log(LevelDebug, fmt.Sprintf(format, args...), LogFields{})
+}
+
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.Log(LevelInfo, fmt.Sprintf(format, args...), LogFields{})
+}
+
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.Log(LevelWarn, fmt.Sprintf(format, args...), LogFields{})
+}
+
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.Log(LevelError, fmt.Sprintf(format, args...), LogFields{})
+}
+
+// LogOptions are the logging options shared by the subcommands
+type LogOptions struct {
+	LogFormat string `long:"logformat" env:"AWXCLIENT_LOGFORMAT" description:"Format of the log written to STDOUT" choice:"text" choice:"json" default:"text"`
+	LogLevel  string `long:"loglevel" env:"AWXCLIENT_LOGLEVEL" description:"Lowest level that is logged" choice:"debug" choice:"info" choice:"warn" choice:"error" default:"info"`
+}
+
+// Setup points the logger at STDOUT with the format and level that were asked for
+func (o LogOptions) Setup() error {
+	level, err := ParseLevel(o.LogLevel)
+	if err != nil {
+		return fmt.Errorf("LogOptions.Setup(): %w", err)
+	}
+
+	format := o.LogFormat
+	if format == "" {
+		format = LogFormatText
+	}
+	logger = NewLogger(os.Stdout, format, level)
+
+	return nil
+}
@@ -12,7 +12,6 @@ type Options struct {
 
 var options Options
 var parser = flags.NewParser(&options, flags.Default)
-var relay bool
 
 // function executions are handled by jessevdk/go-flags
 // the respective init() functions and Execute() methods
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// the metrics the relay exposes on /metrics
+var (
+	buildsStarted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "awxclient_builds_started_total",
+		Help: "Builds started by the relay, including builds resumed after a restart.",
+	}, []string{"facility", "type"})
+
+	buildsFinished = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "awxclient_builds_finished_total",
+		Help: "Builds finished by the relay, by result (successful, failed, cancelled or error).",
+	}, []string{"facility", "type", "result"})
+
+	buildsInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "awxclient_builds_in_flight",
+		Help: "Builds the relay is currently running.",
+	}, []string{"facility", "type"})
+
+	buildDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "awxclient_build_duration_seconds",
+		Help:    "How long builds took from start to finish.",
+		Buckets: prometheus.ExponentialBuckets(60, 2, 9), // 1 minute to a bit over 4 hours
+	}, []string{"facility", "type", "result"})
+
+	stepDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "awxclient_step_duration_seconds",
+		Help:    "How long the AWX job or workflow of each step took, from launch to finish.",
+		Buckets: prometheus.ExponentialBuckets(30, 2, 9), // 30 seconds to a bit over 2 hours
+	}, []string{"step", "status"})
+
+	awxRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "awxclient_awx_request_duration_seconds",
+		Help:    "Latency of the calls to the AWX API.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "path"})
+
+	awxRequestErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "awxclient_awx_request_errors_total",
+		Help: "Calls to the AWX API that failed, by HTTP status code or unreachable if AWX couldn't be reached.",
+	}, []string{"method", "path", "code"})
+)
+
+// the steps awxclient_step_duration_seconds is labelled with, see --metricsstep. The names of the
+// steps come from the awxvars file the host sends, so every other step is counted as other
+var metricsSteps = map[string]bool{}
+
+// otherStep is the step label of the steps which aren't in metricsSteps
+const otherStep = "other"
+
+// SetMetricsSteps sets the steps of the pipeline which get their own step label
+func SetMetricsSteps(names []string) {
+	metricsSteps = make(map[string]bool)
+	for _, name := range names {
+		metricsSteps[name] = true
+	}
+}
+
+// MetricsHandler serves the metrics in the Prometheus text format
+func MetricsHandler() gin.HandlerFunc {
+	return gin.WrapH(promhttp.Handler())
+}
+
+// buildStarted counts a build the relay started
+func buildStarted(jobVars JobVars) {
+	buildsStarted.WithLabelValues(jobVars.Facility, jobVars.Type).Inc()
+	buildsInFlight.WithLabelValues(jobVars.Facility, jobVars.Type).Inc()
+}
+
+// buildFinished counts a build the relay finished, started is when the build was started
+func buildFinished(jobVars JobVars, result string, started time.Time) {
+	buildsInFlight.WithLabelValues(jobVars.Facility, jobVars.Type).Dec()
+	buildsFinished.WithLabelValues(jobVars.Facility, jobVars.Type, result).Inc()
+	buildDuration.WithLabelValues(jobVars.Facility, jobVars.Type, result).Observe(time.Since(started).Seconds())
+}
+
+// observeStep records how long the AWX job of a step took, as recorded in the state of the build
+func observeStep(bc *BuildContext, name string) {
+	step := bc.State.Step(name)
+	if step.Started.IsZero() || step.Finished.IsZero() {
+		return
+	}
+	label := name
+	if !metricsSteps[name] {
+		label = otherStep
+	}
+	stepDuration.WithLabelValues(label, step.Status).Observe(step.Finished.Sub(step.Started).Seconds())
+}
+
+// observeAwxRequest records the latency and outcome of a call to the AWX API
+func observeAwxRequest(request *http.Request, started time.Time, err error) {
+	path := metricsPath(request.URL.Path)
+	awxRequestDuration.WithLabelValues(request.Method, path).Observe(time.Since(started).Seconds())
+
+	if err == nil {
+		return
+	}
+	code := "unreachable"
+	var statusErr *AwxStatusError
+	if errors.As(err, &statusErr) {
+		code = strconv.Itoa(statusErr.StatusCode)
+	}
+	awxRequestErrors.WithLabelValues(request.Method, path, code).Inc()
+}
+
+// metricsPath replaces the IDs in a path of the AWX API so every job doesn't get its own series
+func metricsPath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if _, err := strconv.Atoi(segment); err == nil {
+			segments[i] = ":id"
+		}
+	}
+	return strings.Join(segments, "/")
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// oauthApp is the AWX OAuth2 application tokens are created with
+type oauthApp struct {
+	clientID     string
+	clientSecret string // only set for confidential applications
+}
+
+type oauthTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+// CreateOAuthToken trades a username and password for a short lived token through the
+// password grant of an AWX OAuth2 application, so basic auth can be disabled in AWX
+func CreateOAuthToken(ctx context.Context, config AwxConfig, client *http.Client, username, password string) (*AwxClient, error) {
+	app := &oauthApp{clientID: config.OAuthClientID, clientSecret: config.OAuthClientSecret}
+
+	form := url.Values{
+		"grant_type": {"password"},
+		"username":   {username},
+		"password":   {password},
+		"scope":      {"write"},
+	}
+
+	var token oauthTokenResponse
+	if err := app.post(ctx, client, config.URL+"/api/o/token/", form, &token); err != nil {
+		// a wrong user or password is a 400 invalid_grant rather than a 401
+		var statusErr *AwxStatusError
+		if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusBadRequest {
+			return nil, &Error{Kind: ErrAuthDenied, Err: err}
+		}
+		return nil, fmt.Errorf("CreateOAuthToken(): %w", err)
+	}
+	if token.AccessToken == "" {
+		return nil, fmt.Errorf("CreateOAuthToken(): AWX didn't return a token")
+	}
+
+	awx := NewAwxTokenClient(ctx, config.URL, token.AccessToken, client)
+	awx.app = app
+
+	return awx, nil
+}
+
+// RevokeToken revokes the token the client created, a static token or basic auth is left alone
+func (a *AwxClient) RevokeToken() error {
+	if a == nil || a.app == nil || a.token == "" {
+		return nil
+	}
+
+	// the token is revoked even when the build was cancelled, the timeout of the client still applies
+	form := url.Values{"token": {a.token}}
+	if err := a.app.post(context.Background(), a.client, a.baseURL+"/api/o/revoke_token/", form, nil); err != nil {
+		return fmt.Errorf("RevokeToken(): %w", err)
+	}
+	a.token = ""
+
+	return nil
+}
+
+// post sends a form to one of the OAuth2 endpoints of AWX, confidential applications
+// authenticate with their secret while public ones only pass their client ID
+func (o *oauthApp) post(ctx context.Context, client *http.Client, endpoint string, form url.Values, result interface{}) error {
+	if o.clientSecret == "" {
+		form.Set("client_id", o.clientID)
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return fmt.Errorf("http.NewRequestWithContext(): %w", err)
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if o.clientSecret != "" {
+		request.SetBasicAuth(o.clientID, o.clientSecret)
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		return fmt.Errorf("POST %v: %w", endpoint, awxError(err))
+	}
+	defer response.Body.Close()
+
+	// awxTransport already turned anything outside of 2xx into an *AwxStatusError
+	respBody, err := io.ReadAll(response.Body)
+	if err != nil {
+		return fmt.Errorf("POST %v: io.ReadAll(): %w", endpoint, awxError(err))
+	}
+
+	if result == nil {
+		return nil
+	}
+	if err := json.Unmarshal(respBody, result); err != nil {
+		return fmt.Errorf("POST %v: json.Unmarshal(): %w", endpoint, err)
+	}
+
+	return nil
+}
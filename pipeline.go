@@ -0,0 +1,195 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// step results reported per step of the pipeline
+const (
+	StepSuccessful = "successful"
+	StepFailed     = "failed"
+	StepSkipped    = "skipped" // an earlier step failed and the pipeline stopped
+	StepCancelled  = "cancelled"
+)
+
+// the kinds of AWX templates a step can launch
+const (
+	StepTypeJob      = "job"
+	StepTypeWorkflow = "workflow"
+)
+
+// Step is a single AWX job template launched by the pipeline, as listed in the awxvars file
+type Step struct {
+	Name              string                 `json:"name"`
+	Type              string                 `json:"type"` // job (default) or workflow
+	Template          string                 `json:"template"`
+	ExtraVars         map[string]interface{} `json:"extra_vars"`
+	Limit             string                 `json:"limit"` // defaults to the FQDN of the host
+	ContinueOnFailure bool                   `json:"continue_on_failure"`
+	Retry             RetryPolicy            `json:"retry"`
+	Poll              PollPolicy             `json:"poll"`
+	TemplateID        int                    `json:"-"` // looked up in AWX from Template
+}
+
+// StepResult is the outcome of a single step of the pipeline
+type StepResult struct {
+	Name     string `json:"name"`
+	Template string `json:"template"`
+	JobID    int    `json:"jobid"`
+	Status   string `json:"status"`
+	Error    string `json:"error"`
+}
+
+// ValidateSteps ensures the steps of an awxvars file can be run, and names unnamed steps after their template
+func ValidateSteps(steps []Step) error {
+	if len(steps) == 0 {
+		return fmt.Errorf("no steps are defined")
+	}
+
+	seen := make(map[string]bool)
+	for i := range steps {
+		if steps[i].Template == "" {
+			return fmt.Errorf("step %v: template is empty", i)
+		}
+		if steps[i].Name == "" {
+			steps[i].Name = steps[i].Template
+		}
+		if steps[i].Type == "" {
+			steps[i].Type = StepTypeJob
+		} else if steps[i].Type != StepTypeJob && steps[i].Type != StepTypeWorkflow {
+			return fmt.Errorf("step %v: unknown type %v, must be %v or %v", i, steps[i].Type, StepTypeJob, StepTypeWorkflow)
+		}
+		if err := steps[i].Poll.Validate(); err != nil {
+			return fmt.Errorf("step %v: %w", i, err)
+		}
+		if err := steps[i].Retry.Validate(steps[i].Type); err != nil {
+			return fmt.Errorf("step %v: %w", i, err)
+		}
+		if seen[steps[i].Name] {
+			return fmt.Errorf("step %v: there is more than one step named %v", i, steps[i].Name)
+		}
+		seen[steps[i].Name] = true
+	}
+
+	return nil
+}
+
+// RunPipeline launches every step in order, stopping at the first failed step
+// unless it's allowed to fail. Job steps reuse LaunchJob() and GetStatus(), workflow
+// steps LaunchWorkflow() and GetWorkflowStatus()
+func RunPipeline(bc *BuildContext) ([]StepResult, error) {
+	steps := bc.JobVars.Steps
+	results := make([]StepResult, len(steps))
+	for i, step := range steps {
+		results[i] = StepResult{Name: step.Name, Template: step.Template}
+	}
+
+	var pipelineErr error
+
+	for i, step := range steps {
+		// an earlier step failed or the build was cancelled, don't run anything after it
+		if pipelineErr == nil {
+			pipelineErr = bc.Cancelled()
+		}
+		if pipelineErr != nil {
+			results[i].Status = StepSkipped
+			continue
+		}
+
+		limit := bc.FQDN
+		if step.Limit != "" {
+			limit = expandPlaceholders(step.Limit, bc.JobVars)
+		}
+
+		params := map[string]interface{}{"inventory": bc.JobVars.InvID, "limit": limit}
+		if len(step.ExtraVars) > 0 {
+			params["extra_vars"] = expandExtraVars(step.ExtraVars, bc.JobVars)
+		}
+
+		var jobID int
+		var err error
+		if step.Type == StepTypeWorkflow {
+			jobID, err = LaunchWorkflow(bc, step, params)
+		} else {
+			jobID, err = LaunchJob(bc, step, params)
+		}
+		results[i].JobID = jobID
+
+		if errors.Is(err, ErrCancelled) {
+			// a cancelled build stops even if the step is allowed to fail
+			results[i].Status = StepCancelled
+			pipelineErr = err
+		} else if err != nil {
+			results[i].Status = StepFailed
+			results[i].Error = err.Error()
+
+			if step.ContinueOnFailure {
+				bc.PrintStatus(fmt.Sprintf("INFO: %v failed but is allowed to fail, continuing: %v", step.Name, err))
+			} else if errors.Is(err, ErrJobFailed) {
+				pipelineErr = err
+			} else {
+				pipelineErr = fmt.Errorf("RunPipeline(): %w", err)
+			}
+		} else {
+			results[i].Status = StepSuccessful
+		}
+
+		bc.Build.SetSteps(results)
+	}
+
+	bc.Build.SetSteps(results)
+
+	return results, pipelineErr
+}
+
+// PrintStepResults writes a summary line for every step to the log of the build
+func PrintStepResults(bc *BuildContext, results []StepResult) {
+	for _, result := range results {
+		if result.JobID != 0 {
+			bc.PrintStatus(fmt.Sprintf("INFO: %v: %v (job id %v)", result.Name, result.Status, result.JobID))
+		} else {
+			bc.PrintStatus(fmt.Sprintf("INFO: %v: %v", result.Name, result.Status))
+		}
+	}
+}
+
+// expandPlaceholders fills in the {fqdn}, {desired_release}, {facility}, {type} and {distro}
+// placeholders which can be used in the limit and extra_vars of a step
+func expandPlaceholders(value string, jobVars JobVars) string {
+	replacer := strings.NewReplacer(
+		"{fqdn}", jobVars.FQDN,
+		"{desired_release}", jobVars.DesiredRelease,
+		"{facility}", jobVars.Facility,
+		"{type}", jobVars.Type,
+		"{distro}", jobVars.Distro,
+	)
+	return replacer.Replace(value)
+}
+
+// expandExtraVars returns a copy of extra vars with the placeholders in every string filled in
+func expandExtraVars(extraVars map[string]interface{}, jobVars JobVars) map[string]interface{} {
+	expanded := make(map[string]interface{}, len(extraVars))
+	for key, value := range extraVars {
+		expanded[key] = expandValue(value, jobVars)
+	}
+	return expanded
+}
+
+func expandValue(value interface{}, jobVars JobVars) interface{} {
+	switch v := value.(type) {
+	case string:
+		return expandPlaceholders(v, jobVars)
+	case map[string]interface{}:
+		return expandExtraVars(v, jobVars)
+	case []interface{}:
+		expanded := make([]interface{}, len(v))
+		for i, item := range v {
+			expanded[i] = expandValue(item, jobVars)
+		}
+		return expanded
+	default:
+		return value
+	}
+}
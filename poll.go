@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// how a job is polled when neither the step nor the awxvars file say otherwise
+const (
+	defaultPollDelay    = 30 * time.Second
+	defaultPollInterval = 10 * time.Second
+	defaultPollTimeout  = 30 * time.Minute
+)
+
+// the longest GetStatus() waits between calls to AWX that keep failing
+const maxPollBackoff = 5 * time.Minute
+
+// PollPolicy says how the AWX job of a step is followed, set per step or for every step in the awxvars file
+type PollPolicy struct {
+	Delay    string `json:"delay"`    // how long to wait after the job is launched before checking it, ex. 30s
+	Interval string `json:"interval"` // how long to wait between checks, ex. 10s
+	Timeout  string `json:"timeout"`  // how long the job has to finish, ex. 1h
+}
+
+// Validate ensures every duration of the policy can be parsed
+func (p PollPolicy) Validate() error {
+	for name, value := range map[string]string{"delay": p.Delay, "interval": p.Interval, "timeout": p.Timeout} {
+		if value == "" {
+			continue
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 || (d == 0 && name != "delay") {
+			return fmt.Errorf("poll %v %q isn't a valid duration, ex. 10s or 1h", name, value)
+		}
+	}
+	return nil
+}
+
+// Or fills in what isn't set in the policy from defaults
+func (p PollPolicy) Or(defaults PollPolicy) PollPolicy {
+	if p.Delay == "" {
+		p.Delay = defaults.Delay
+	}
+	if p.Interval == "" {
+		p.Interval = defaults.Interval
+	}
+	if p.Timeout == "" {
+		p.Timeout = defaults.Timeout
+	}
+	return p
+}
+
+// pollDuration parses value, falling back to fallback when it isn't set
+func pollDuration(value string, fallback time.Duration) time.Duration {
+	if d, err := time.ParseDuration(value); err == nil && value != "" {
+		return d
+	}
+	return fallback
+}
+
+// jobPoller paces the checks of a running AWX job or workflow. It backs off when AWX can't be
+// reached, and gives up once the job took longer than the timeout of its step
+type jobPoller struct {
+	bc       *BuildContext
+	what     string // ex. job id 12, used in the log and errors
+	delay    time.Duration
+	interval time.Duration
+	timeout  time.Duration
+	deadline time.Time
+
+	failures   int    // calls to AWX that failed in a row
+	lastErr    error  // the last call to AWX that failed
+	lastStatus string // the status AWX last reported for the job
+}
+
+func newJobPoller(bc *BuildContext, what string, policy PollPolicy) *jobPoller {
+	p := &jobPoller{
+		bc:       bc,
+		what:     what,
+		delay:    pollDuration(policy.Delay, defaultPollDelay),
+		interval: pollDuration(policy.Interval, defaultPollInterval),
+		timeout:  pollDuration(policy.Timeout, defaultPollTimeout),
+	}
+	p.deadline = time.Now().Add(p.timeout)
+	return p
+}
+
+// Start waits for the job to get going before it's checked the first time
+func (p *jobPoller) Start() error {
+	if p.delay == 0 {
+		return nil
+	}
+	p.bc.PrintStatus(fmt.Sprintf("INFO: Waiting %v so %v can run...", p.delay, p.what))
+	return p.bc.Sleep(p.delay)
+}
+
+// Seen records the status AWX reported for the job
+func (p *jobPoller) Seen(status string) {
+	p.lastStatus = status
+	p.failures = 0
+	p.lastErr = nil
+}
+
+// Failed records a call to AWX that failed. Errors which calling AWX again won't fix, ex. the
+// credentials being refused, are returned, otherwise the job is checked again after a backoff
+func (p *jobPoller) Failed(err error) error {
+	// the call was abandoned because the build was cancelled
+	if cancelled := p.bc.Cancelled(); cancelled != nil {
+		return cancelled
+	}
+	if !transientAwxError(err) {
+		return err
+	}
+
+	p.failures++
+	p.lastErr = err
+	p.bc.PrintStatus(fmt.Sprintf("INFO: Couldn't check %v (%v failed calls to AWX in a row), trying again in %v: %v",
+		p.what, p.failures, p.wait(), err))
+
+	return nil
+}
+
+// Next waits until the job should be checked again. It returns an ErrCancelled error when the
+// build is cancelled, and an ErrTimeout error once the job took longer than the timeout
+func (p *jobPoller) Next() error {
+	if time.Now().After(p.deadline) {
+		return p.timeoutError()
+	}
+	// don't back off past the deadline, the job may have finished in the meantime
+	wait := p.wait()
+	if remaining := time.Until(p.deadline); wait > remaining {
+		wait = remaining
+	}
+	// the job is checked one last time at the deadline before giving up on it
+	return p.bc.Sleep(wait)
+}
+
+// wait returns how long to wait before the next check, doubling the interval for every call to AWX that failed in a row
+func (p *jobPoller) wait() time.Duration {
+	wait := p.interval
+	for i := 0; i < p.failures && wait < maxPollBackoff; i++ {
+		wait *= 2
+	}
+	// a step that polls less often than maxPollBackoff anyway keeps its interval
+	if wait > maxPollBackoff && p.interval < maxPollBackoff {
+		wait = maxPollBackoff
+	}
+	return wait
+}
+
+func (p *jobPoller) timeoutError() error {
+	status := p.lastStatus
+	if status == "" {
+		status = "unknown"
+	}
+
+	if p.lastErr != nil {
+		return NewError(ErrTimeout, "%v didn't complete within %v, its last known status was %v and the last %v calls to AWX failed: %v",
+			p.what, p.timeout, status, p.failures, p.lastErr)
+	}
+	return NewError(ErrTimeout, "%v didn't complete within %v, its last status was %v. Something is probably wrong",
+		p.what, p.timeout, status)
+}
+
+// transientAwxError says whether a failed call to AWX is worth making again. The calls
+// awx-go makes that time out aren't run through awxError(), so they're checked here too
+func transientAwxError(err error) bool {
+	if errors.Is(awxError(err), ErrAwxUnreachable) {
+		return true
+	}
+
+	var statusErr *AwxStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= http.StatusInternalServerError || statusErr.StatusCode == http.StatusTooManyRequests
+	}
+
+	return false
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newSlowAwx returns an AWX client whose calls time out after timeout. The server hangs on
+// /slow/ and the awx-go ping, and responds to /status/[code]/ with that status code
+func newSlowAwx(t *testing.T, timeout time.Duration) *AwxClient {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if code := strings.TrimPrefix(strings.Trim(r.URL.Path, "/"), "status/"); code != strings.Trim(r.URL.Path, "/") {
+			status, _ := strconv.Atoi(code)
+			w.WriteHeader(status)
+			return
+		}
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	client, err := AwxConfig{}.HTTPClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Timeout = timeout
+
+	return NewAwxClient(context.Background(), server.URL, "relay", "secret", client)
+}
+
+func TestTransientAwxError(t *testing.T) {
+	awx := newSlowAwx(t, 50*time.Millisecond)
+	ctx := context.Background()
+
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	unreachable := NewAwxClient(ctx, closed.URL, "relay", "secret", awx.client)
+
+	tests := []struct {
+		name      string
+		err       error
+		transient bool
+	}{
+		{"raw call timed out", awx.GetJSON(ctx, "/slow/", nil, nil), true},
+		{"awx-go call timed out", func() error { _, err := awx.PingService.Ping(); return err }(), true},
+		{"unreachable", unreachable.GetJSON(ctx, "/api/v2/ping/", nil, nil), true},
+		{"500", awx.GetJSON(ctx, "/status/500/", nil, nil), true},
+		{"502", awx.GetJSON(ctx, "/status/502/", nil, nil), true},
+		{"503", awx.GetJSON(ctx, "/status/503/", nil, nil), true},
+		{"429", awx.GetJSON(ctx, "/status/429/", nil, nil), true},
+		{"400", awx.GetJSON(ctx, "/status/400/", nil, nil), false},
+		{"401", awx.GetJSON(ctx, "/status/401/", nil, nil), false},
+		{"403", awx.GetJSON(ctx, "/status/403/", nil, nil), false},
+		{"404", awx.GetJSON(ctx, "/status/404/", nil, nil), false},
+		{"not an AWX error", io.ErrUnexpectedEOF, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.err == nil {
+				t.Fatal("the call to AWX didn't fail")
+			}
+			if got := transientAwxError(test.err); got != test.transient {
+				t.Errorf("transientAwxError(%v) = %v, expected %v", test.err, got, test.transient)
+			}
+		})
+	}
+}
+
+func TestJobPollerFailed(t *testing.T) {
+	logger = NewLogger(io.Discard, LogFormatText, LevelError)
+	awx := newSlowAwx(t, 50*time.Millisecond)
+
+	b, _, err := builds.New("poller.dc1.example.com", "dc1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bc := &BuildContext{FQDN: "poller.dc1.example.com", Build: b}
+	poller := newJobPoller(bc, "job id 1", PollPolicy{Interval: "10s"})
+
+	// a call that timed out is made again, backing off every time
+	for i := 1; i <= 3; i++ {
+		if err := poller.Failed(awx.GetJSON(bc.Context(), "/slow/", nil, nil)); err != nil {
+			t.Fatalf("a call that timed out failed the poll: %v", err)
+		}
+		if expected := 10 * time.Second << i; poller.wait() != expected {
+			t.Errorf("after %v failed calls the poller waits %v, expected %v", i, poller.wait(), expected)
+		}
+	}
+
+	// a call AWX refused isn't
+	if err := poller.Failed(awx.GetJSON(bc.Context(), "/status/404/", nil, nil)); err == nil {
+		t.Error("a 404 didn't fail the poll")
+	}
+
+	// and a call abandoned because the build was cancelled cancels the poll
+	b.Cancel()
+	if err := poller.Failed(awx.GetJSON(bc.Context(), "/slow/", nil, nil)); !errors.Is(err, ErrCancelled) {
+		t.Errorf("a cancelled build failed the poll with %v, expected it to be cancelled", err)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// headers carrying the signature of a request sent to the relay
+const (
+	headerKeyID     = "X-Awxclient-Key"
+	headerTimestamp = "X-Awxclient-Timestamp"
+	headerNonce     = "X-Awxclient-Nonce"
+	headerSignature = "X-Awxclient-Signature"
+)
+
+// how old a signed request can be before the relay refuses it, this also covers clock drift between the host and the relay
+const signatureMaxAge = 5 * time.Minute
+
+// RelayKey is the shared secret a host signs its requests to the relay with, it's left by Foreman next to the env file
+type RelayKey struct {
+	ID     string
+	Secret string
+}
+
+// RelayKeyFile returns where Foreman leaves the relay key, ex. /etc/bam.env -> /etc/bam-relay.key
+func RelayKeyFile(envFile string) string {
+	return strings.TrimSuffix(envFile, ".env") + "-relay.key"
+}
+
+// ReadRelayKey reads the key used to sign requests to the relay
+func ReadRelayKey() (RelayKey, error) {
+	var key RelayKey
+
+	envFile, err := ForemanEnvFile()
+	if err != nil {
+		return key, Wrap("ReadRelayKey()", err)
+	}
+
+	keyFile := RelayKeyFile(envFile)
+	data, err := ReadFile(keyFile)
+	if err != nil {
+		return key, fmt.Errorf("ReadRelayKey(): %w", err)
+	}
+
+	key.ID = strings.TrimSpace(data["keyid"])
+	key.Secret = strings.TrimSpace(data["secret"])
+	if key.ID == "" || key.Secret == "" {
+		return key, NewError(ErrConfig, "%v needs keyid and secret to be set in order to talk to the AWX Relay", keyFile)
+	}
+
+	return key, nil
+}
+
+// Sign adds the headers the relay needs to verify a request came from a host holding the key
+func (k RelayKey) Sign(request *http.Request, body []byte) error {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("RelayKey.Sign(): rand.Read(): %w", err)
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	request.Header.Set(headerKeyID, k.ID)
+	request.Header.Set(headerTimestamp, timestamp)
+	request.Header.Set(headerNonce, hex.EncodeToString(nonce))
+	request.Header.Set(headerSignature, signature(k.Secret, request.Method, request.URL.Path, timestamp, hex.EncodeToString(nonce), body))
+
+	return nil
+}
+
+// signature is the HMAC-SHA256 of everything that makes a request unique, so
+// neither the body nor the endpoint can be changed without the secret
+func signature(secret, method, path, timestamp, nonce string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%v\n%v\n%v\n%v\n", method, path, timestamp, nonce)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// RelayKeys maps the ID of each key the relay accepts to its secret
+type RelayKeys map[string]string
+
+// LoadRelayKeys reads the keys the relay accepts from a file of keyid=secret lines
+func LoadRelayKeys(path string) (RelayKeys, error) {
+	data, err := ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("LoadRelayKeys(): %w", err)
+	}
+
+	keys := make(RelayKeys)
+	for id, secret := range data {
+		id, secret = strings.TrimSpace(id), strings.TrimSpace(secret)
+		if strings.HasPrefix(id, "#") || id == "" || secret == "" {
+			continue
+		}
+		keys[id] = secret
+	}
+
+	// without any keys every request would be refused
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("LoadRelayKeys(): %v doesn't contain any keys", path)
+	}
+
+	return keys, nil
+}
+
+// nonceCache remembers the nonces of recent requests so a captured request can't be sent again
+type nonceCache struct {
+	mu     sync.Mutex
+	nonces map[string]time.Time
+}
+
+var seenNonces = &nonceCache{nonces: make(map[string]time.Time)}
+
+// add records a nonce and returns false if it was already used
+func (n *nonceCache) add(nonce string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	// requests older than signatureMaxAge are refused anyway, so their nonces can be forgotten
+	for key, seen := range n.nonces {
+		if time.Since(seen) > 2*signatureMaxAge {
+			delete(n.nonces, key)
+		}
+	}
+
+	if _, ok := n.nonces[nonce]; ok {
+		return false
+	}
+	n.nonces[nonce] = time.Now()
+
+	return true
+}
+
+// RequireSignature refuses any request that isn't signed by one of the keys the relay accepts
+func RequireSignature(keys RelayKeys) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if err := verifyRequest(c.Request, keys); err != nil {
+			logger.Errorf("refused %v %v from %v: %v", c.Request.Method, c.Request.URL.Path, c.ClientIP(), err)
+			abortWithError(c, &Error{Kind: ErrUnauthorized, Err: err},
+				fmt.Sprintf("Ensure %v on the host holds a key configured in the relay keys file, and that the clocks of both are in sync.", RelayKeyFile("/etc/[bam|dss].env")))
+			return
+		}
+		c.Next()
+	}
+}
+
+// verifyRequest checks the signature of a request, the body is put back so the handler can still read it
+func verifyRequest(request *http.Request, keys RelayKeys) error {
+	keyID := request.Header.Get(headerKeyID)
+	timestamp := request.Header.Get(headerTimestamp)
+	nonce := request.Header.Get(headerNonce)
+	signed := request.Header.Get(headerSignature)
+
+	if keyID == "" || timestamp == "" || nonce == "" || signed == "" {
+		return fmt.Errorf("the request isn't signed, ensure the host has a relay key next to its env file")
+	}
+
+	secret, ok := keys[strings.ToLower(keyID)]
+	if !ok {
+		return fmt.Errorf("key %q isn't configured on the relay", keyID)
+	}
+
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("the timestamp %q of the request is invalid", timestamp)
+	}
+	if age := time.Since(time.Unix(unix, 0)); age > signatureMaxAge || age < -signatureMaxAge {
+		return fmt.Errorf("the request was signed %v ago, check the clocks of the host and the relay", age.Round(time.Second))
+	}
+
+	var body []byte
+	if request.Body != nil {
+		if body, err = io.ReadAll(request.Body); err != nil {
+			return fmt.Errorf("io.ReadAll(): %w", err)
+		}
+		request.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	expected := signature(secret, request.Method, request.URL.Path, timestamp, nonce, body)
+	if !hmac.Equal([]byte(expected), []byte(signed)) {
+		return fmt.Errorf("the signature doesn't match, ensure the host and the relay have the same secret for key %q", keyID)
+	}
+
+	// only checked once the signature is valid, so nobody can fill the cache with junk
+	if !seenNonces.add(nonce) {
+		return fmt.Errorf("the request was already received once, refusing to replay it")
+	}
+
+	return nil
+}
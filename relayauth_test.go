@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifyRequest(t *testing.T) {
+	key := RelayKey{ID: "test", Secret: "c2VjcmV0=="}
+	keys := RelayKeys{key.ID: key.Secret}
+	body := []byte(`{"fqdn":"web01.dc1.example.com"}`)
+
+	// resign signs the request again after a header was changed, so it's only that header the relay refuses
+	resign := func(request *http.Request, secret string) {
+		request.Header.Set(headerSignature, signature(secret, request.Method, request.URL.Path,
+			request.Header.Get(headerTimestamp), request.Header.Get(headerNonce), body))
+	}
+
+	tests := []struct {
+		name   string
+		modify func(request *http.Request)
+		err    string // empty when the request is accepted
+	}{
+		{"signed", func(request *http.Request) {}, ""},
+		{"key id in another case", func(request *http.Request) { request.Header.Set(headerKeyID, "TEST") }, ""},
+		{"signed a minute ago", func(request *http.Request) {
+			request.Header.Set(headerTimestamp, strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10))
+			resign(request, key.Secret)
+		}, ""},
+
+		{"no key id", func(request *http.Request) { request.Header.Del(headerKeyID) }, "isn't signed"},
+		{"no timestamp", func(request *http.Request) { request.Header.Del(headerTimestamp) }, "isn't signed"},
+		{"no nonce", func(request *http.Request) { request.Header.Del(headerNonce) }, "isn't signed"},
+		{"no signature", func(request *http.Request) { request.Header.Del(headerSignature) }, "isn't signed"},
+		{"unknown key", func(request *http.Request) { request.Header.Set(headerKeyID, "other") }, "isn't configured"},
+		{"invalid timestamp", func(request *http.Request) { request.Header.Set(headerTimestamp, "yesterday") }, "is invalid"},
+
+		{"signed with another secret", func(request *http.Request) { resign(request, "b3RoZXI=") }, "doesn't match"},
+		{"signature tampered with", func(request *http.Request) {
+			request.Header.Set(headerSignature, strings.Repeat("0", 64))
+		}, "doesn't match"},
+		{"body changed", func(request *http.Request) {
+			request.Body = io.NopCloser(strings.NewReader(`{"fqdn":"db01.dc1.example.com"}`))
+		}, "doesn't match"},
+		{"endpoint changed", func(request *http.Request) { request.URL.Path = "/build/123" }, "doesn't match"},
+
+		{"signed 6 minutes ago", func(request *http.Request) {
+			request.Header.Set(headerTimestamp, strconv.FormatInt(time.Now().Add(-6*time.Minute).Unix(), 10))
+			resign(request, key.Secret)
+		}, "check the clocks"},
+		{"signed 6 minutes from now", func(request *http.Request) {
+			request.Header.Set(headerTimestamp, strconv.FormatInt(time.Now().Add(6*time.Minute).Unix(), 10))
+			resign(request, key.Secret)
+		}, "check the clocks"},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			request := newSignedRequest(t, key, body)
+			test.modify(request)
+
+			err := verifyRequest(request, keys)
+			switch {
+			case test.err == "" && err != nil:
+				t.Fatalf("verifyRequest() = %v, expected the request to be accepted", err)
+			case test.err != "" && err == nil:
+				t.Fatalf("verifyRequest() accepted the request, expected it to be refused with %q", test.err)
+			case test.err != "" && !strings.Contains(err.Error(), test.err):
+				t.Fatalf("verifyRequest() = %v, expected it to be refused with %q", err, test.err)
+			}
+
+			// the handler still gets to read the body of a request that was accepted
+			if err == nil {
+				if read, _ := io.ReadAll(request.Body); !bytes.Equal(read, body) {
+					t.Errorf("the body of the request is %q after it was verified, expected %q", read, body)
+				}
+			}
+		})
+	}
+}
+
+func TestVerifyRequestReplayed(t *testing.T) {
+	key := RelayKey{ID: "test", Secret: "c2VjcmV0=="}
+	keys := RelayKeys{key.ID: key.Secret}
+	body := []byte(`{"fqdn":"web01.dc1.example.com"}`)
+
+	request := newSignedRequest(t, key, body)
+	if err := verifyRequest(request, keys); err != nil {
+		t.Fatalf("verifyRequest() = %v, expected the request to be accepted", err)
+	}
+
+	// the exact same request, nonce included, captured and sent again
+	replayed := request.Clone(request.Context())
+	replayed.Body = io.NopCloser(bytes.NewReader(body))
+	if err := verifyRequest(replayed, keys); err == nil || !strings.Contains(err.Error(), "already received") {
+		t.Errorf("verifyRequest() = %v for a replayed request, expected it to be refused", err)
+	}
+
+	// while a new request signed by the same host is accepted
+	if err := verifyRequest(newSignedRequest(t, key, body), keys); err != nil {
+		t.Errorf("verifyRequest() = %v, expected a request with a new nonce to be accepted", err)
+	}
+}
+
+// newSignedRequest returns a POST /build/ signed with key
+func newSignedRequest(t *testing.T, key RelayKey, body []byte) *http.Request {
+	request, err := http.NewRequest(http.MethodPost, "http://relay.example.com:8080/build/", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := key.Sign(request, body); err != nil {
+		t.Fatal(err)
+	}
+	return request
+}
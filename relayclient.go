@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// how long a single request to the relay can take. The event stream of a build stays open for as
+// long as the build runs, so instead it's dropped and reconnected once the relay goes quiet for longer
+// than relayStreamIdle, the relay sends a keep-alive every eventKeepAlive
+const (
+	relayRequestTimeout = time.Minute
+	relayStreamIdle     = 3 * eventKeepAlive
+)
+
+// RelayOptions are the options of the subcommands that talk to the relay
+type RelayOptions struct {
+	RelayPort string `short:"r" long:"relayport" description:"If the default port of the AWX relay was changed, set it here" default:"8080"`
+	HTTPS     bool   `long:"https" description:"Talk to the AWX relay over HTTPS"`
+	RelayCA   string `long:"relayca" description:"CA certificate(s) the certificate of the AWX relay is verified against, defaults to the system's trusted CAs"`
+	Cert      string `long:"cert" description:"Certificate of the host, presented to the AWX relay if it verifies its clients"`
+	CertKey   string `long:"certkey" description:"Private key of the certificate of the host"`
+}
+
+// RelayClient sends signed requests to the relay, over HTTPS when the relay options ask for it
+type RelayClient struct {
+	baseURL string
+	key     RelayKey
+	client  *http.Client
+	stream  *http.Client // for the event stream, which the timeout of client would cut off
+}
+
+// NewRelayClient sets up the client for the relay running on host
+func NewRelayClient(host string, key RelayKey, f *RelayOptions) (*RelayClient, error) {
+	scheme := "http"
+	transport := http.DefaultTransport
+
+	if f.HTTPS {
+		scheme = "https"
+
+		tlsConfig, err := relayClientTLS(f)
+		if err != nil {
+			return nil, fmt.Errorf("NewRelayClient(): %w", err)
+		}
+		transport = &http.Transport{TLSClientConfig: tlsConfig}
+	}
+
+	return &RelayClient{
+		baseURL: fmt.Sprintf("%v://%v:%v", scheme, host, f.RelayPort),
+		key:     key,
+		client:  &http.Client{Transport: transport, Timeout: relayRequestTimeout},
+		stream:  &http.Client{Transport: transport},
+	}, nil
+}
+
+// relayClientTLS trusts the CA the relay's certificate was issued by, and presents
+// the certificate of the host if the relay verifies its clients
+func relayClientTLS(f *RelayOptions) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	// without a CA file the system's trusted CAs are used
+	if f.RelayCA != "" {
+		pool, err := LoadCertPool(f.RelayCA)
+		if err != nil {
+			return nil, fmt.Errorf("relayClientTLS(): %w", err)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if f.Cert != "" || f.CertKey != "" {
+		cert, err := tls.LoadX509KeyPair(f.Cert, f.CertKey)
+		if err != nil {
+			return nil, fmt.Errorf("relayClientTLS(): tls.LoadX509KeyPair(): %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// LoadCertPool reads a PEM file of CA certificates
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("LoadCertPool(): os.ReadFile(): %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("LoadCertPool(): %v doesn't contain any PEM encoded certificates", path)
+	}
+
+	return pool, nil
+}
+
+// Do sends a signed request to an endpoint of the relay and returns the response along with its body
+func (r *RelayClient) Do(method, endpoint string, body []byte) (*http.Response, []byte, error) {
+	request, err := http.NewRequest(method, r.baseURL+endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, fmt.Errorf("http.NewRequest(): %w", err)
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	if err := r.key.Sign(request, body); err != nil {
+		return nil, nil, err
+	}
+
+	response, err := r.client.Do(request)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%v %v: %w", method, request.URL, err)
+	}
+	defer response.Body.Close()
+
+	respBody, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%v %v: io.ReadAll(): %w", method, request.URL, err)
+	}
+
+	return response, respBody, nil
+}
+
+// Events streams the events of a build from the relay, starting after the event with the ID after,
+// and passes each of them to handle. It returns once the stream ends or ctx is cancelled, or with an
+// error when the relay sent nothing, not even a keep-alive, for relayStreamIdle
+func (r *RelayClient) Events(ctx context.Context, buildID string, after int, handle func(BuildEvent)) error {
+	streamCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	idle := time.AfterFunc(relayStreamIdle, cancel)
+	defer idle.Stop()
+
+	request, err := http.NewRequestWithContext(streamCtx, http.MethodGet, r.baseURL+"/build/"+buildID+"/events", nil)
+	if err != nil {
+		return fmt.Errorf("RelayClient.Events(): http.NewRequest(): %w", err)
+	}
+	request.Header.Set("Accept", "text/event-stream")
+	if after > 0 {
+		request.Header.Set("Last-Event-ID", strconv.Itoa(after))
+	}
+	if err := r.key.Sign(request, nil); err != nil {
+		return fmt.Errorf("RelayClient.Events(): %w", err)
+	}
+
+	response, err := r.stream.Do(request)
+	if err != nil {
+		return fmt.Errorf("RelayClient.Events(): GET %v: %w", request.URL, err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(response.Body)
+		return fmt.Errorf("RelayClient.Events(): %w", relayErrorFromBody(response.Status, respBody))
+	}
+
+	// events are made up of field: value lines and end with an empty line, lines starting with : are comments
+	scanner := bufio.NewScanner(response.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	var data strings.Builder
+	for scanner.Scan() {
+		idle.Reset(relayStreamIdle)
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if data.Len() > 0 {
+				var event BuildEvent
+				if err := json.Unmarshal([]byte(data.String()), &event); err == nil {
+					handle(event)
+				}
+				data.Reset()
+			}
+		case strings.HasPrefix(line, "data:"):
+			data.WriteString(strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+	if err := scanner.Err(); err != nil && ctx.Err() == nil {
+		if streamCtx.Err() != nil {
+			return fmt.Errorf("RelayClient.Events(): the relay sent nothing for %v: %w", relayStreamIdle, err)
+		}
+		return fmt.Errorf("RelayClient.Events(): %w", err)
+	}
+
+	return nil
+}
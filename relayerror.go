@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// codes of the errors the relay sends back to the client, see kinds in errors.go
+const (
+	ErrCodeJobFailed      = "job_failed"      // an AWX job failed, not a program issue
+	ErrCodeSkippedAll     = "skipped_all"     // every task of an AWX job was skipped on the host
+	ErrCodeAwxUnreachable = "awx_unreachable" // the relay can't reach AWX
+	ErrCodeAwxCredentials = "awx_credentials" // AWX refused the credentials of the relay
+	ErrCodeUnauthorized   = "unauthorized"    // the request isn't signed correctly
+	ErrCodeForbidden      = "forbidden"       // the certificate of the host isn't allowed to do this
+	ErrCodeNotFound       = "not_found"       // the relay doesn't know about the build
+	ErrCodeDNSMismatch    = "dns_mismatch"    // the DNS A record of the host doesn't match Foreman
+	ErrCodeConfiguration  = "configuration"   // the awxvars file, inventory mapping or AWX don't match up
+	ErrCodeNetwork        = "network"         // the host isn't connected to the network
+	ErrCodeEnvFile        = "env_file"        // the environment file left by Foreman is missing or incomplete
+	ErrCodeAwxVars        = "awxvars"         // the awxvars file can't be fetched
+	ErrCodeTimeout        = "timeout"         // an AWX job didn't finish in time
+	ErrCodeCleanUp        = "cleanup"         // the build succeeded but cleaning up after it didn't
+	ErrCodeCancelled      = "cancelled"       // the build was cancelled through the relay or awxclient cancel
+	ErrCodeInternal       = "internal"        // something went wrong in the relay
+)
+
+const pteRemediation = "There is an issue with the AWX Relay, please reach out to Platform Engineering."
+
+// RelayError is the error the relay sends back to the client, with what to do about it
+type RelayError struct {
+	Code        string `json:"code"`
+	Message     string `json:"message"`
+	Remediation string `json:"remediation"`
+}
+
+func (e *RelayError) Error() string {
+	return fmt.Sprintf("%v (%v). %v", e.Message, e.Code, e.Remediation)
+}
+
+// Is lets errors.Is() match the kind of error the relay reported
+func (e *RelayError) Is(target error) bool {
+	kind := kindOfCode(e.Code)
+	return kind != nil && errors.Is(kind, target)
+}
+
+// abortWithError stops handling a request and sends the error back to the client
+func abortWithError(c *gin.Context, err error, remediation string) {
+	c.AbortWithStatusJSON(HTTPStatus(err), &RelayError{Code: ErrorCode(err), Message: err.Error(), Remediation: remediation})
+}
+
+// BuildError works out what went wrong with a build that didn't succeed
+func BuildError(bc *BuildContext, err error) *RelayError {
+	if err == nil {
+		return nil
+	}
+
+	relayErr := &RelayError{Code: ErrorCode(err), Message: err.Error()}
+	switch relayErr.Code {
+	case ErrCodeJobFailed:
+		relayErr.Remediation = "Check the output of the AWX job above, fix the issue and run awxclient foreman again. Steps which already completed won't run again."
+	case ErrCodeSkippedAll:
+		relayErr.Remediation = "Check that the type, distro and release of the host match the conditions of the playbook, fix whichever is wrong and run awxclient foreman again. Steps which already completed won't run again."
+	case ErrCodeAwxCredentials:
+		relayErr.Remediation = fmt.Sprintf("AWX refused the credentials of the relay, they're read from %v on the relay. The host being built doesn't need any AWX credentials.", bc.AwxConfig.Credentials)
+	case ErrCodeAwxUnreachable:
+		relayErr.Remediation = fmt.Sprintf("The relay can't reach AWX at %v, check that AWX is up. Running awxclient foreman again picks up where the build left off.", bc.AwxConfig.URL)
+	case ErrCodeTimeout:
+		relayErr.Remediation = "Check in AWX whether the job is stuck. Running awxclient foreman again reattaches to the job if it's still running."
+	case ErrCodeCancelled:
+		relayErr.Remediation = "Run awxclient foreman again to start the build over. Steps which already completed won't run again."
+	case ErrCodeConfiguration:
+		relayErr.Remediation = "Ensure the awxvars file, the inventory mapping of the relay and the templates and inventories in AWX match up."
+	default:
+		relayErr.Remediation = pteRemediation
+	}
+
+	return relayErr
+}
+
+// relayErrorFromBody decodes the error sent back by the relay, older relays only send a string
+func relayErrorFromBody(status string, body []byte) *RelayError {
+	var relayErr RelayError
+	if err := json.Unmarshal(body, &relayErr); err == nil && relayErr.Code != "" {
+		return &relayErr
+	}
+
+	return &RelayError{
+		Code:        ErrCodeInternal,
+		Message:     fmt.Sprintf("%v: %v", status, strings.Trim(string(body), "\"")),
+		Remediation: pteRemediation,
+	}
+}
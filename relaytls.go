@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ClientRule lets hosts whose certificate has a CN or SAN matching Pattern build hosts in Facilities
+type ClientRule struct {
+	Pattern    string   `json:"pattern"`
+	Facilities []string `json:"facilities"`
+}
+
+// ClientRules decides which facilities each client certificate is allowed to build hosts in
+type ClientRules struct {
+	Clients []ClientRule `json:"clients"`
+
+	path string
+}
+
+// the gin context key the facilities allowed by the client certificate are stored under
+const allowedFacilitiesKey = "allowedFacilities"
+
+// LoadClientRules reads and validates the client certificate rules
+func LoadClientRules(path string) (*ClientRules, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("LoadClientRules(): os.ReadFile(): %w", err)
+	}
+
+	rules := &ClientRules{path: path}
+	if err := json.Unmarshal(data, rules); err != nil {
+		return nil, fmt.Errorf("LoadClientRules(): json.Unmarshal(): %v: %w", path, err)
+	}
+
+	if err := rules.Validate(); err != nil {
+		return nil, fmt.Errorf("LoadClientRules(): %w", err)
+	}
+
+	return rules, nil
+}
+
+// Validate makes sure every rule has a valid pattern and at least one facility
+func (r *ClientRules) Validate() error {
+	if len(r.Clients) == 0 {
+		return fmt.Errorf("%v doesn't contain any clients", r.path)
+	}
+
+	for i, rule := range r.Clients {
+		if rule.Pattern == "" {
+			return fmt.Errorf("%v: client %v is missing pattern", r.path, i)
+		}
+		if _, err := path.Match(rule.Pattern, ""); err != nil {
+			return fmt.Errorf("%v: client %v has an invalid pattern %q: %w", r.path, i, rule.Pattern, err)
+		}
+		if len(rule.Facilities) == 0 {
+			return fmt.Errorf("%v: client %q is missing facilities", r.path, rule.Pattern)
+		}
+	}
+
+	return nil
+}
+
+// Facilities returns the facilities a certificate is allowed to build hosts in, the first matching rule wins
+func (r *ClientRules) Facilities(cert *x509.Certificate) ([]string, bool) {
+	names := append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+
+	for _, rule := range r.Clients {
+		for _, name := range names {
+			if matched, _ := path.Match(rule.Pattern, name); matched && name != "" {
+				return rule.Facilities, true
+			}
+		}
+	}
+
+	return nil, false
+}
+
+// RelayServerTLS sets up TLS for the relay, clients have to present a certificate
+// issued by clientCA when it's set
+func RelayServerTLS(clientCA string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if clientCA != "" {
+		pool, err := LoadCertPool(clientCA)
+		if err != nil {
+			return nil, fmt.Errorf("RelayServerTLS(): %w", err)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, nil
+}
+
+// RequireClientCert refuses clients whose certificate doesn't match any of the rules, and
+// records which facilities the certificate is allowed to build hosts in
+func RequireClientCert(rules *ClientRules) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.TLS == nil || len(c.Request.TLS.PeerCertificates) == 0 {
+			abortWithError(c, NewError(ErrUnauthorized, "a client certificate is required"),
+				"Run awxclient foreman with --https, --cert and --certkey.")
+			return
+		}
+
+		cert := c.Request.TLS.PeerCertificates[0]
+		facilities, ok := rules.Facilities(cert)
+		if !ok {
+			logger.Errorf("refused %v %v from %v: certificate %v doesn't match any client in %v",
+				c.Request.Method, c.Request.URL.Path, c.ClientIP(), cert.Subject.CommonName, rules.path)
+			abortWithError(c, NewError(ErrForbidden, "certificate %v isn't allowed to use the relay", cert.Subject.CommonName),
+				"Add a client matching the certificate to the client certificate rules of the relay.")
+			return
+		}
+
+		c.Set(allowedFacilitiesKey, facilities)
+		c.Next()
+	}
+}
+
+// facilityAllowed checks whether the client certificate may build a host in facility,
+// anything goes when the relay doesn't check client certificates against rules
+func facilityAllowed(c *gin.Context, facility string) bool {
+	value, ok := c.Get(allowedFacilitiesKey)
+	if !ok {
+		return true
+	}
+
+	for _, allowed := range value.([]string) {
+		if allowed == "*" || allowed == facility {
+			return true
+		}
+	}
+
+	return false
+}
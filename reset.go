@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+type ResetCommand struct {
+	FQDN     string `short:"f" long:"fqdn" description:"FQDN of the host whose build state is cleared, defaults to this host"`
+	StateDir string `short:"s" long:"statedir" description:"Directory the state of each build is kept in" default:"/var/lib/awxclient"`
+}
+
+var resetCommand ResetCommand
+
+func init() {
+	parser.AddCommand("reset", "Clears the saved state of a build", "Clears the saved state of a build so the next run launches every AWX job again instead of resuming", &resetCommand)
+}
+
+// Main function for the reset subcommand
+func (r *ResetCommand) Execute(args []string) error {
+	fqdn := r.FQDN
+	if fqdn == "" {
+		var err error
+		if fqdn, err = os.Hostname(); err != nil {
+			return fmt.Errorf("reset: os.Hostname(): %w", err)
+		}
+	}
+
+	if err := ResetBuildState(r.StateDir, fqdn); err != nil {
+		return fmt.Errorf("reset: %w", err)
+	}
+	fmt.Printf("INFO: Cleared the build state of %v\n", fqdn)
+
+	return nil
+}
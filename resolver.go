@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// how long an ID looked up by name is trusted before asking AWX again, so a
+// template that was recreated in AWX is picked up without restarting the relay
+const nameCacheTTL = 15 * time.Minute
+
+type nameCacheEntry struct {
+	id      int
+	expires time.Time
+}
+
+// NameCache caches the IDs of AWX objects which were looked up by name
+type NameCache struct {
+	mu      sync.Mutex
+	entries map[string]nameCacheEntry
+}
+
+// shared by every build on the relay
+var awxNames = &NameCache{entries: make(map[string]nameCacheEntry)}
+
+// namedObject is the part of an AWX object needed to match it by name
+type namedObject struct {
+	ID   int
+	Name string
+}
+
+// resolve returns the ID of the only object of kind called name, list is only
+// called when the ID isn't cached already
+func (n *NameCache) resolve(kind, name string, list func() ([]namedObject, error)) (int, error) {
+	key := kind + "/" + name
+
+	n.mu.Lock()
+	entry, ok := n.entries[key]
+	n.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.id, nil
+	}
+
+	objects, err := list()
+	if err != nil {
+		return 0, err
+	}
+
+	// AWX filters on name, but make sure we only count exact matches
+	var ids []int
+	for _, object := range objects {
+		if object.Name == name {
+			ids = append(ids, object.ID)
+		}
+	}
+
+	if len(ids) == 0 {
+		return 0, NewError(ErrConfig, "there is no %v named %q in AWX, ensure the name in the awxvars file is correct", kind, name)
+	} else if len(ids) > 1 {
+		return 0, NewError(ErrConfig, "%v %vs are named %q in AWX (IDs %v), the name needs to be unique", len(ids), kind, name, ids)
+	}
+
+	n.mu.Lock()
+	n.entries[key] = nameCacheEntry{id: ids[0], expires: time.Now().Add(nameCacheTTL)}
+	n.mu.Unlock()
+
+	return ids[0], nil
+}
+
+// ResolveJobTemplate returns the ID of the AWX job template called name
+func (bc *BuildContext) ResolveJobTemplate(name string) (int, error) {
+	return awxNames.resolve("job template", name, func() ([]namedObject, error) {
+		result, _, err := bc.AWX.JobTemplateService.ListJobTemplates(map[string]string{"name": name})
+		if err != nil {
+			return nil, fmt.Errorf("ResolveJobTemplate(): awx.JobTemplateService.ListJobTemplates(): %w", err)
+		}
+
+		var objects []namedObject
+		for _, template := range result {
+			objects = append(objects, namedObject{ID: template.ID, Name: template.Name})
+		}
+		return objects, nil
+	})
+}
+
+// ResolveInventory returns the ID of the AWX inventory called name
+func (bc *BuildContext) ResolveInventory(name string) (int, error) {
+	return awxNames.resolve("inventory", name, func() ([]namedObject, error) {
+		result, _, err := bc.AWX.InventoriesService.ListInventories(map[string]string{"name": name})
+		if err != nil {
+			return nil, fmt.Errorf("ResolveInventory(): awx.InventoriesService.ListInventories(): %w", err)
+		}
+
+		var objects []namedObject
+		for _, inventory := range result {
+			objects = append(objects, namedObject{ID: inventory.ID, Name: inventory.Name})
+		}
+		return objects, nil
+	})
+}
+
+// ResolveJobVars looks up the IDs of the job and workflow templates and inventory named in the
+// awxvars file, so that a missing or ambiguous name fails the build before anything runs
+func ResolveJobVars(bc *BuildContext) error {
+	var err error
+
+	if bc.JobVars.InvID, err = bc.ResolveInventory(bc.JobVars.InvName); err != nil {
+		return err
+	}
+	for i, step := range bc.JobVars.Steps {
+		if step.Type == StepTypeWorkflow {
+			bc.JobVars.Steps[i].TemplateID, err = bc.ResolveWorkflowTemplate(step.Template)
+		} else {
+			bc.JobVars.Steps[i].TemplateID, err = bc.ResolveJobTemplate(step.Template)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
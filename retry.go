@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// the classes of failures a step can be retried on
+const (
+	RetryOnFailed      = "failed"      // a task failed on the host
+	RetryOnUnreachable = "unreachable" // Ansible couldn't reach the host
+	RetryOnTimeout     = "timeout"     // the job didn't finish in time, it's cancelled before it's relaunched
+	RetryOnError       = "error"       // AWX couldn't run the job, ex. the project failed to update
+)
+
+// how long a step waits before it's relaunched when the policy doesn't say, and the longest it ever waits
+const defaultRetryBackoff = time.Minute
+const maxRetryBackoff = 30 * time.Minute
+
+// RetryPolicy says how a job step that failed is relaunched, the step is only launched once without one
+type RetryPolicy struct {
+	Attempts int      `json:"attempts"` // how many times the step is launched at most, including the first time
+	Backoff  string   `json:"backoff"`  // how long to wait before relaunching the first time, doubled every time after, ex. 2m
+	On       []string `json:"on"`       // the classes of failures worth retrying, defaults to failed and unreachable
+}
+
+// Validate ensures the policy can be applied to a step of type stepType
+func (p RetryPolicy) Validate(stepType string) error {
+	if p.Attempts <= 1 {
+		if p.Attempts < 0 {
+			return fmt.Errorf("retry attempts can't be negative")
+		}
+		return nil
+	}
+
+	if stepType == StepTypeWorkflow {
+		return fmt.Errorf("retry is only supported by job steps, AWX can't relaunch the failed hosts of a workflow")
+	}
+	if p.Backoff != "" {
+		if backoff, err := time.ParseDuration(p.Backoff); err != nil || backoff < 0 {
+			return fmt.Errorf("retry backoff %q isn't a duration, ex. 30s or 2m", p.Backoff)
+		}
+	}
+	for _, class := range p.On {
+		if class != RetryOnFailed && class != RetryOnUnreachable && class != RetryOnTimeout && class != RetryOnError {
+			return fmt.Errorf("unknown retry class %q, must be %v, %v, %v or %v", class, RetryOnFailed, RetryOnUnreachable, RetryOnTimeout, RetryOnError)
+		}
+	}
+
+	return nil
+}
+
+// MaxAttempts returns how many times the step is launched at most
+func (p RetryPolicy) MaxAttempts() int {
+	if p.Attempts < 1 {
+		return 1
+	}
+	return p.Attempts
+}
+
+// Delay returns how long to wait after attempt failed before relaunching the step
+func (p RetryPolicy) Delay(attempt int) time.Duration {
+	delay := defaultRetryBackoff
+	if p.Backoff != "" {
+		delay, _ = time.ParseDuration(p.Backoff)
+	}
+
+	for i := 1; i < attempt && delay < maxRetryBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryBackoff {
+		delay = maxRetryBackoff
+	}
+
+	return delay
+}
+
+// Retryable says whether a step that failed with err should be launched again
+func (p RetryPolicy) Retryable(err error) bool {
+	classes := p.On
+	if len(classes) == 0 {
+		classes = []string{RetryOnFailed, RetryOnUnreachable}
+	}
+
+	for _, class := range classes {
+		if failureClass(err) == class {
+			return true
+		}
+	}
+	return false
+}
+
+// failureClass returns the class of the failure of a job, or an empty string for failures that are
+// never retried, ex. a cancelled build, AWX being unreachable or a job every task was skipped in,
+// which would skip them all again
+func failureClass(err error) string {
+	switch {
+	case errors.Is(err, ErrSkippedAll):
+		return ""
+	case errors.Is(err, ErrHostUnreachable):
+		return RetryOnUnreachable
+	case errors.Is(err, ErrJobError):
+		return RetryOnError
+	case errors.Is(err, ErrJobFailed):
+		return RetryOnFailed
+	case errors.Is(err, ErrTimeout):
+		return RetryOnTimeout
+	default:
+		return ""
+	}
+}
+
+// relaunchResponse is the new job AWX created when relaunching a job
+type relaunchResponse struct {
+	ID int `json:"id"`
+}
+
+// RelaunchJob relaunches an AWX job on the hosts it failed on and returns the ID of the new job.
+// AWX refuses to do that when no host failed, ex. the job was cancelled, then it's relaunched on all its hosts
+func RelaunchJob(bc *BuildContext, jobID int) (int, error) {
+	var result relaunchResponse
+	endpoint := fmt.Sprintf("/api/v2/jobs/%v/relaunch/", jobID)
+
+	err := bc.AWX.PostJSON(bc.Context(), endpoint, map[string]string{"hosts": "failed"}, &result)
+	var statusErr *AwxStatusError
+	if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusBadRequest {
+		bc.PrintStatus(fmt.Sprintf("INFO: Job id %v has no failed hosts to relaunch, relaunching it on all its hosts", jobID))
+		err = bc.AWX.PostJSON(bc.Context(), endpoint, map[string]string{"hosts": "all"}, &result)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("RelaunchJob(): %w", err)
+	}
+
+	return result.ID, nil
+}
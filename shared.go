@@ -1,13 +1,12 @@
 package main
 
 import (
-	"crypto/tls"
+	"context"
 	"errors"
 	"fmt"
 	"io/fs"
 	"net/http"
 	"os"
-	"regexp"
 	"strings"
 	"time"
 
@@ -15,25 +14,117 @@ import (
 )
 
 type JobVars struct {
-	BreakglassID    int
-	BreakglassName  string
-	BaselineID      int
-	BaselineName    string
-	InvID           int
-	InvName         string
-	DesiredRelease  string
-	Reboot          string
-	FQDN            string
-	BreakglassJobID string
-	BaselineJobID   string
-	Type            string
-	Facility        string
-	Mock            string
-	Relay           string
+	Steps          []Step
+	InvID          int
+	InvName        string
+	DesiredRelease string
+	Reboot         string
+	FQDN           string
+	Type           string
+	Facility       string
+	Distro         string
+	Mock           string
+	Relay          string
 }
 
-// global so it doesn't have to be passed around a million times
-var awx *awxGo.AWX
+// BuildContext carries everything a single build needs. The relay creates one per
+// request so concurrent builds never share their FQDN, log file or AWX client
+type BuildContext struct {
+	FQDN        string
+	JobVars     JobVars
+	AWX         *AwxClient
+	Inventories *InventoryMap
+	AwxConfig   AwxConfig
+	Log         *StatusLogger
+	State       *BuildState
+	Build       *Build     // only set on the relay, used to report progress to the client
+	Run         *RunStatus // only set by foreman, summarizes the run for the status file
+
+	step  string // the step and AWX job the build is on, added to every log line
+	jobID int
+}
+
+// PrintStatus writes the output to the log along with the fields of the build, to
+// the human-readable log file of the build if it has one, and to the clients following the build
+func (bc *BuildContext) PrintStatus(msg string) error {
+	logger.Print(msg, bc.LogFields())
+	bc.Build.Log(msg)
+	return bc.Log.Print(msg)
+}
+
+// LogFields returns what identifies the build in the log
+func (bc *BuildContext) LogFields() LogFields {
+	buildID := bc.Build.Status().ID
+	if buildID == "" {
+		buildID = bc.State.RelayBuildID()
+	}
+
+	return LogFields{
+		FQDN:     bc.FQDN,
+		Facility: bc.JobVars.Facility,
+		Type:     bc.JobVars.Type,
+		BuildID:  buildID,
+		Step:     bc.step,
+		JobID:    bc.jobID,
+	}
+}
+
+// SetPhase records the phase of the build for the client and in the state file
+func (bc *BuildContext) SetPhase(phase, step string) {
+	bc.step = step
+	bc.jobID = 0
+	bc.Build.SetPhase(phase, step)
+	bc.CheckState(bc.State.SetPhase(phase))
+}
+
+// SetJobID records the AWX job the current step is waiting on
+func (bc *BuildContext) SetJobID(jobID int) {
+	bc.jobID = jobID
+	bc.Build.SetJobID(jobID)
+}
+
+// Context is cancelled when the build is cancelled through the relay
+func (bc *BuildContext) Context() context.Context {
+	return bc.Build.Context()
+}
+
+// Cancelled returns an ErrCancelled error once the build was cancelled
+func (bc *BuildContext) Cancelled() error {
+	if bc.Context().Err() != nil {
+		return NewError(ErrCancelled, "the build of %v was cancelled", bc.FQDN)
+	}
+	return nil
+}
+
+// CancelledOr returns an ErrCancelled error in place of err once the build was cancelled, the
+// calls to AWX in flight at the time fail with whatever error abandoning them caused
+func (bc *BuildContext) CancelledOr(err error) error {
+	if err == nil || errors.Is(err, ErrCancelled) || bc.Cancelled() == nil {
+		return err
+	}
+	return NewError(ErrCancelled, "the build of %v was cancelled: %w", bc.FQDN, err)
+}
+
+// Sleep waits for d, or returns an ErrCancelled error as soon as the build is cancelled
+func (bc *BuildContext) Sleep(d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-bc.Context().Done():
+		return bc.Cancelled()
+	}
+}
+
+// CheckState logs a failure to save the state file, the build carries on since
+// the state is only needed if the build is interrupted
+func (bc *BuildContext) CheckState(err error) {
+	if err != nil {
+		bc.PrintStatus(fmt.Sprintf("ERROR: couldn't save the build state: %v", err))
+	}
+}
 
 // CheckDistro() checks whether the host is running CentOS or Rocky Linux
 func CheckDistro() (string, error) {
@@ -46,100 +137,74 @@ func CheckDistro() (string, error) {
 	}
 }
 
-// GetGroupID gets the group id of the matching datacenter in an inventory
-func GetGroupID(jobVars JobVars) (int, error) {
-	var groupID int
+// GetGroupID gets the group id of the group the host belongs to in the inventory of its mapping
+func GetGroupID(bc *BuildContext, mapping InventoryMapping) (int, error) {
+	groupName := mapping.GroupName(bc.JobVars)
 
-	//TODO: Add in plain English error message when the group doesn't exist
-	result, _, err := awx.GroupService.ListGroups(map[string]string{"name": jobVars.Facility})
+	result, _, err := bc.AWX.GroupService.ListGroups(map[string]string{"name": groupName})
 	if err != nil {
-		return groupID, fmt.Errorf("getGroupID(): awx.GroupService.ListGroups(): %w", err)
+		return 0, fmt.Errorf("getGroupID(): awx.GroupService.ListGroups(): %w", err)
 	}
 
+	// groups with the same name can exist in multiple inventories
 	for _, value := range result {
-		//TODO: these inventory IDs probably shouldn't be hardcoded
-		if jobVars.InvID == 44 && value.Inventory == 44 {
-			groupID = value.ID
-			break
-		} else if jobVars.InvID == 392 && value.Inventory == 392 {
-			groupID = value.ID
-			break
-		} else if jobVars.InvID == 513 && value.Inventory == 513 {
-			groupID = value.ID
-			break
-		} else if jobVars.InvID == 516 && value.Inventory == 516 {
-			groupID = value.ID
-			break
+		if value.Inventory == mapping.InventoryID {
+			return value.ID, nil
 		}
 	}
 
-	return groupID, nil
+	return 0, NewError(ErrConfig, "can't find the %v group in the %v inventory, ensure it exists", groupName, mapping.InventoryName)
 }
 
 // DoesHostExist checks through the list of hosts in AWX for the FQDN and ensures it exists in the correct inventory
-func DoesHostExist(fqdn string, jobVars JobVars) error {
-	result, _, err := awx.HostService.ListHosts(map[string]string{"name": fqdn})
+func DoesHostExist(bc *BuildContext) error {
+	fqdn := bc.FQDN
+
+	mapping, err := bc.Inventories.Lookup(bc.JobVars)
 	if err != nil {
 		return err
 	}
 
-	var invName string
+	// the awxvars file and the mapping file have to agree, otherwise the host would be
+	// created in one inventory and the jobs launched against another
+	if bc.JobVars.InvName != "" && bc.JobVars.InvName != mapping.InventoryName {
+		return NewError(ErrConfig, "the awxvars inventory %v doesn't match the %v inventory mapped for %v",
+			bc.JobVars.InvName, mapping.InventoryName, mapping)
+	}
 
+	if mapping.InventoryID, err = bc.ResolveInventory(mapping.InventoryName); err != nil {
+		return err
+	}
+
+	result, _, err := bc.AWX.HostService.ListHosts(map[string]string{"name": fqdn})
+	if err != nil {
+		return err
+	}
+
+	// host can be in multiple inventories
 	for _, host := range result {
-		if host.Name == fqdn {
-			// host can be in multiple inventories
-			switch host.Inventory {
-			// TODO: these inventory IDs probably shouldn't be hardcoded
-			case 44:
-				if strings.Contains(jobVars.DesiredRelease, "7.") && jobVars.Type == "internal" {
-					invName = "Foreman_Hosts"
-				}
-			case 392:
-				if strings.Contains(jobVars.DesiredRelease, "8.") && jobVars.Type == "internal" {
-					invName = "Rocky Foreman"
-				}
-			case 513:
-				if jobVars.Type == "midtier" {
-					invName = "Midtier-Baremetal"
-				}
-			case 516:
-				if jobVars.Type == "edge" {
-					invName = "Edge-Baremetal"
-				}
-			}
-			PrintStatus(fmt.Sprintf("INFO: Found %v in inventory %v", fqdn, invName))
+		if host.Name == fqdn && host.Inventory == mapping.InventoryID {
+			bc.PrintStatus(fmt.Sprintf("INFO: Found %v in inventory %v", fqdn, mapping.InventoryName))
 			return nil
 		}
 	}
 
-	PrintStatus(fmt.Sprintf("INFO: Couldn't find %v in any inventory", fqdn))
-	PrintStatus("INFO: Attempting to create it...")
-	if err := CreateHost(fqdn, jobVars); err != nil {
-		if strings.Contains(err.Error(), "ERROR") {
-			return err
-		}
-		return fmt.Errorf("doesHostExist(): %w", err)
+	bc.PrintStatus(fmt.Sprintf("INFO: Couldn't find %v in the %v inventory", fqdn, mapping.InventoryName))
+	bc.PrintStatus("INFO: Attempting to create it...")
+	if err := CreateHost(bc, mapping); err != nil {
+		return Wrap("doesHostExist()", err)
 	}
 
 	return nil
 }
 
 // CreateHost adds an FQDN to an AWX inventory
-func CreateHost(fqdn string, jobVars JobVars) error {
-	var err error
-
-	// if we're building an internal host the incoming jobVars is empty, fill it out
-	if jobVars.Type == "internal" {
-		jobVars, err = ReadAwxVars() //read from a local file
-	}
+func CreateHost(bc *BuildContext, mapping InventoryMapping) error {
+	fqdn := bc.FQDN
 
-	if err != nil {
-		return fmt.Errorf("createHost(): %w", err)
-	}
-
-	_, err = awx.HostService.CreateHost(map[string]interface{}{
+	_, err := bc.AWX.HostService.CreateHost(map[string]interface{}{
 		"name":        fqdn,
-		"inventory":   jobVars.InvID,
+		"inventory":   mapping.InventoryID,
 		"description": "Host built by Foreman",
 		"enabled":     true,
 	}, map[string]string{})
@@ -148,35 +213,34 @@ func CreateHost(fqdn string, jobVars JobVars) error {
 		return fmt.Errorf("createHost(): awx.HostService.CreateHost(): %w", err)
 	}
 
-	if err = AddHostToGroup(fqdn, jobVars); err != nil {
-		if strings.Contains(err.Error(), "ERROR") {
-			return err
-		}
-		return fmt.Errorf("createHost(): %w", err)
+	if err = AddHostToGroup(bc, mapping); err != nil {
+		return Wrap("createHost()", err)
 	}
 
-	PrintStatus(fmt.Sprintf("INFO: Successfully created %v and added it to the %v inventory", fqdn, jobVars.InvName))
+	bc.PrintStatus(fmt.Sprintf("INFO: Successfully created %v and added it to the %v inventory", fqdn, mapping.InventoryName))
 
 	return nil
 }
 
 // AddHostToGroup associates an FQDN with an AWX inventory group
-func AddHostToGroup(fqdn string, jobVars JobVars) error {
-	groupID, err := GetGroupID(jobVars)
+func AddHostToGroup(bc *BuildContext, mapping InventoryMapping) error {
+	fqdn := bc.FQDN
+	groupName := mapping.GroupName(bc.JobVars)
+	groupID, err := GetGroupID(bc, mapping)
 
 	if err != nil {
-		return fmt.Errorf("addHostToGroup(): %w", err)
+		return Wrap("addHostToGroup()", err)
 	}
 
 	// getting the ID of the host
-	hosts, _, err := awx.HostService.ListHosts(map[string]string{"name": fqdn})
+	hosts, _, err := bc.AWX.HostService.ListHosts(map[string]string{"name": fqdn})
 	if err != nil {
 		return fmt.Errorf("addHostToGroup(): awx.HostService.ListHosts(): %w", err)
 	}
 
 	var hostID int
 	for _, host := range hosts {
-		if host.Name == fqdn {
+		if host.Name == fqdn && host.Inventory == mapping.InventoryID {
 			hostID = host.ID
 		}
 	}
@@ -185,93 +249,231 @@ func AddHostToGroup(fqdn string, jobVars JobVars) error {
 		return errors.New("addHostToGroup(): can't find host ID")
 	}
 
-	_, err = awx.HostService.AssociateGroup(hostID, map[string]interface{}{"id": groupID}, map[string]string{})
+	_, err = bc.AWX.HostService.AssociateGroup(hostID, map[string]interface{}{"id": groupID}, map[string]string{})
 
-	if err != nil && strings.Contains(err.Error(), "Bad Request") || err != nil && strings.Contains(err.Error(), "404") {
-		return fmt.Errorf((fmt.Sprintf("Ensure %v group exists in the %v inventory", jobVars.Facility, jobVars.InvName)))
+	var statusErr *AwxStatusError
+	if errors.As(err, &statusErr) && (statusErr.StatusCode == http.StatusBadRequest || statusErr.StatusCode == http.StatusNotFound) {
+		return NewError(ErrConfig, "ensure %v group exists in the %v inventory", groupName, mapping.InventoryName)
 	}
 
 	if err != nil {
 		return fmt.Errorf("addHostToGroup(): awx.HostService.AssociateGroup(): %w", err)
 	}
 
-	PrintStatus(fmt.Sprintf("INFO: Successfully added %v to the %v group in %v", fqdn, jobVars.Facility, jobVars.InvName))
+	bc.PrintStatus(fmt.Sprintf("INFO: Successfully added %v to the %v group in %v", fqdn, groupName, mapping.InventoryName))
 
 	return nil
 }
 
-// LaunchJob kicks off an AWX job template
-func LaunchJob(fqdn, templateName string, templateID int, params map[string]interface{}) error {
-	successFile := fmt.Sprintf("/var/tmp/%v-%v.success", fqdn, templateName)
+// LaunchJob kicks off an AWX job template and returns the ID of the job it launched. A job that fails
+// is relaunched on the hosts it failed on as long as the retry policy of the step allows it
+func LaunchJob(bc *BuildContext, step Step, params map[string]interface{}) (int, error) {
+	templateName, retry := step.Name, step.Retry
 
-	if DoesFileExist(successFile) {
-		// job already executed
-		return fmt.Errorf(fmt.Sprintf("LaunchJob(): %v exists not launching %v", successFile, templateName))
+	// the state file knows whether this step already ran, or is still running in AWX
+	jobID, done := ResumeStep(bc, templateName)
+	if done {
+		return jobID, nil
 	}
 
-	PrintStatus(fmt.Sprintf("INFO: Kicking off %v...", templateName))
-	result, err := awx.JobTemplateService.Launch(templateID, params, map[string]string{})
-	if err != nil {
-		return fmt.Errorf("LaunchJob: awx.JobTemplateService.Launch(): %v", err)
+	// a resumed step carries on counting its attempts, so a restart doesn't hand it a fresh set of retries
+	attempt, relaunch := 1, false
+	if jobID != 0 {
+		resumed := bc.State.Step(templateName)
+		if resumed.Attempts > attempt {
+			attempt = resumed.Attempts
+		}
+		relaunch = resumed.Status == StepRetrying
 	}
 
-	// checks the status of the job every 10 seconds until it completes or errors out
-	jobSummary, jobErr := GetStatus(result.ID)
-	if jobErr != nil {
-		// job failure
-		if strings.Contains(jobErr.Error(), "failed") {
-			return jobErr
-		} else {
-			// software issue
-			return fmt.Errorf("launchJob(): %w", jobErr)
+	bc.SetPhase(PhaseRunning, templateName)
+	if jobID == 0 {
+		bc.PrintStatus(fmt.Sprintf("INFO: Kicking off %v...", templateName))
+		launched := time.Now()
+		result, err := bc.AWX.JobTemplateService.Launch(step.TemplateID, params, map[string]string{})
+		if err != nil {
+			return 0, launchInterrupted(bc, step, "jobs", params, launched,
+				fmt.Errorf("LaunchJob(): awx.JobTemplateService.Launch(): %w", err))
 		}
+		jobID = result.ID
+		bc.CheckState(bc.State.StepLaunched(templateName, jobID, attempt))
 	}
 
-	PrintStatus(fmt.Sprintf("INFO: Status of %v: %v", templateName, jobSummary.Status))
+	// only how the job went on the host being built counts, unless the step runs against other hosts
+	var host string
+	if limit, _ := params["limit"].(string); strings.EqualFold(limit, bc.FQDN) {
+		host = bc.FQDN
+	}
 
-	os.Create(successFile)
+	var status string
+	for {
+		if relaunch {
+			launched := time.Now()
+			newJobID, err := RelaunchJob(bc, jobID)
+			if err != nil {
+				return jobID, Wrap("launchJob()", launchInterrupted(bc, step, "jobs", params, launched, err))
+			}
+			attempt++
+			bc.PrintStatus(fmt.Sprintf("INFO: Relaunched %v as job id %v, attempt %v of %v", templateName, newJobID, attempt, retry.MaxAttempts()))
+			jobID = newJobID
+			bc.CheckState(bc.State.StepLaunched(templateName, jobID, attempt))
+		}
+		relaunch = true
+		bc.SetJobID(jobID)
 
-	return nil
+		// checks the status of the job until it completes or errors out
+		var jobErr error
+		status, jobErr = GetStatus(bc, jobID, host, step.Poll)
+		if jobErr == nil {
+			break
+		}
+
+		if errors.Is(jobErr, ErrCancelled) {
+			// the job is only still running if it's the build that was cancelled, not the job
+			if bc.Cancelled() != nil {
+				CancelJob(bc, "jobs", jobID)
+			}
+			bc.CheckState(bc.State.StepFinished(templateName, StepCancelled))
+			observeStep(bc, templateName)
+			return jobID, jobErr
+		}
+
+		if attempt >= retry.MaxAttempts() || !retry.Retryable(jobErr) {
+			// job failure
+			if errors.Is(jobErr, ErrJobFailed) {
+				bc.CheckState(bc.State.StepFinished(templateName, StepFailed))
+				observeStep(bc, templateName)
+				return jobID, jobErr
+			}
+			// software issue, the job may well still be running so leave it to be reattached to
+			return jobID, Wrap("launchJob()", jobErr)
+		}
+
+		delay := retry.Delay(attempt)
+		bc.PrintStatus(fmt.Sprintf("INFO: %v failed on attempt %v of %v (%v), relaunching it in %v: %v",
+			templateName, attempt, retry.MaxAttempts(), failureClass(jobErr), delay, jobErr))
+		if errors.Is(jobErr, ErrTimeout) {
+			CancelJob(bc, "jobs", jobID)
+		}
+		bc.CheckState(bc.State.StepFinished(templateName, StepFailed))
+		observeStep(bc, templateName)
+
+		// a restart during the wait relaunches the job straight away, see ResumeStep()
+		bc.CheckState(bc.State.StepFinished(templateName, StepRetrying))
+		if err := bc.Sleep(delay); err != nil {
+			bc.CheckState(bc.State.StepFinished(templateName, StepCancelled))
+			return jobID, err
+		}
+	}
+
+	bc.PrintStatus(fmt.Sprintf("INFO: Status of %v: %v", templateName, status))
+	bc.CheckState(bc.State.StepFinished(templateName, StepSuccessful))
+	observeStep(bc, templateName)
+
+	return jobID, nil
 }
 
-// GetStatus continually checks the job status until its either no longer pending or running, or in error
-func GetStatus(jobID int) (*awxGo.HostSummaryJob, error) {
-	var job []awxGo.HostSummary
-	var jobHostSummary *awxGo.HostSummaryJob
-	var err error
-	var sleeptime int
+// CancelJob cancels an AWX job, or a workflow job when kind is workflow_jobs, failing to do so is only logged
+func CancelJob(bc *BuildContext, kind string, jobID int) {
+	bc.PrintStatus(fmt.Sprintf("INFO: Cancelling job id %v in AWX...", jobID))
+	// not bound to the build, the job is usually cancelled because the build was
+	if err := bc.AWX.PostJSON(context.Background(), fmt.Sprintf("/api/v2/%v/%v/cancel/", kind, jobID), nil, nil); err != nil {
+		bc.PrintStatus(fmt.Sprintf("ERROR: couldn't cancel job id %v, cancel it in AWX: %v", jobID, err))
+		return
+	}
+	bc.PrintStatus(fmt.Sprintf("INFO: Cancelled job id %v", jobID))
+}
+
+// launchInterrupted handles a launch of the AWX job of a step that failed. When it failed because the
+// build was cancelled AWX may have launched the job before the request was abandoned, without its ID
+// ever making it back to us, so the job is looked up and cancelled. kind is jobs or workflow_jobs
+func launchInterrupted(bc *BuildContext, step Step, kind string, params map[string]interface{}, launched time.Time, err error) error {
+	if bc.Cancelled() == nil {
+		return err
+	}
+
+	templateField := "job_template"
+	if kind == "workflow_jobs" {
+		templateField = "workflow_job_template"
+	}
+	limit, _ := params["limit"].(string)
 
-	PrintStatus("INFO: Sleeping for a few minutes so the job can run...")
-	time.Sleep(30 * time.Second)
-	sleeptime += 30
+	// allow for the clock of AWX being a little off from ours
+	query := map[string]string{
+		templateField:  fmt.Sprint(step.TemplateID),
+		"created__gte": launched.Add(-time.Minute).UTC().Format(time.RFC3339),
+	}
+	var jobs struct {
+		Results []AwxJob `json:"results"`
+	}
+	// not bound to the build, which was cancelled already
+	if listErr := bc.AWX.GetJSON(context.Background(), fmt.Sprintf("/api/v2/%v/", kind), query, &jobs); listErr != nil {
+		bc.PrintStatus(fmt.Sprintf("ERROR: couldn't check whether AWX launched %v before the build was cancelled, cancel it in AWX if it did: %v", step.Name, listErr))
+	}
+	for _, job := range jobs.Results {
+		if job.Running() && strings.EqualFold(job.Limit, limit) {
+			CancelJob(bc, kind, job.ID)
+		}
+	}
+
+	bc.CheckState(bc.State.StepFinished(step.Name, StepCancelled))
+	return bc.CancelledOr(err)
+}
+
+// GetStatus continually checks the status of a job until it's no longer pending or running, and then
+// works out whether it succeeded on host (see JobOutcome()). How often it's checked and for how long is
+// set by the poll policy of the step
+func GetStatus(bc *BuildContext, jobID int, host string, poll PollPolicy) (string, error) {
+	// the Ansible output of the job is written to the build log while we wait
+	events := NewJobEventStream(bc, jobID)
+	followEvents := func() {
+		if err := events.Poll(); err != nil {
+			bc.PrintStatus(fmt.Sprintf("INFO: Couldn't fetch the output of job id %v: %v", jobID, err))
+		}
+	}
+
+	poller := newJobPoller(bc, fmt.Sprintf("job id %v", jobID), poll)
+	if err := poller.Start(); err != nil {
+		return "", err
+	}
 
 	for {
-		job, _, err = awx.JobService.GetHostSummaries(jobID, map[string]string{})
-		if err != nil {
-			return nil, err
+		followEvents()
+
+		job, err := GetJob(bc, jobID)
+		var summary *awxGo.HostSummary
+		if err == nil && !job.Running() && host != "" {
+			summary, err = GetHostSummary(bc, jobID, host)
 		}
 
-		for _, value := range job {
-			if value.Failed || value.SummaryFields.Job.Status == "failed" {
-				return jobHostSummary, fmt.Errorf("%v failed at %v. Check job id %v for more info",
-					value.SummaryFields.Job.JobTemplateName, GetTime("short"), value.Job)
+		if err != nil {
+			if err := poller.Failed(fmt.Errorf("GetStatus(): %w", err)); err != nil {
+				return "", err
 			}
-			if value.SummaryFields.Job.Status != "pending" && value.SummaryFields.Job.Status != "running" {
-				jobHostSummary = value.SummaryFields.Job
-				return jobHostSummary, nil
+		} else {
+			poller.Seen(job.Status)
+			if !job.Running() {
+				// catch up on the output so we know which task failed
+				followEvents()
+				return job.Status, JobOutcome(job, summary, host, events)
 			}
 		}
 
-		// check again in ten seconds
-		time.Sleep(10 * time.Second)
-		sleeptime += 10
-
-		if sleeptime > 1800 {
-			return jobHostSummary, fmt.Errorf("job ID %v didn't complete after a half hour, something is probably wrong", jobID)
+		// check again once the interval has passed, or later when AWX couldn't be reached
+		if err := poller.Next(); err != nil {
+			return job.Status, err
 		}
 	}
 }
 
+// jobFailed creates the ErrJobFailed error of a job, which is also an ErrHostUnreachable error when Ansible couldn't reach the host
+func jobFailed(unreachable bool, format string, args ...interface{}) error {
+	if unreachable {
+		return &Error{Kind: ErrJobFailed, Err: NewError(ErrHostUnreachable, format, args...)}
+	}
+	return NewError(ErrJobFailed, format, args...)
+}
+
 // GetTime gets the current time in the current timezone
 func GetTime(length string) string {
 	current_time := time.Now()
@@ -283,6 +485,15 @@ func GetTime(length string) string {
 
 }
 
+// ValidateFQDN ensures an FQDN can be used as the name of the files kept for its host, which
+// live under the state and log directories and mustn't point anywhere outside them
+func ValidateFQDN(fqdn string) error {
+	if fqdn == "" || strings.ContainsAny(fqdn, `/\`) || strings.HasPrefix(fqdn, ".") {
+		return NewError(ErrConfig, "%q isn't a valid FQDN", fqdn)
+	}
+	return nil
+}
+
 func DoesFileExist(path string) bool {
 	if _, err := os.Stat(path); err != nil {
 		if errors.Is(err, fs.ErrNotExist) {
@@ -292,59 +503,6 @@ func DoesFileExist(path string) bool {
 	return true
 }
 
-// PrintStatus writes the output to STDOUT or to a file based on execution mode
-func PrintStatus(msg string) error {
-	// output to a logfile
-	if relay {
-		logfilePath := "/var/log/awx-relay"
-		logfile := fmt.Sprintf(logfilePath+"/%v.log", ReadMidtierFqdn())
-		// ensure the log directory exists before we attempt to write to it
-		if _, err := os.Stat("/var/log/awx-relay"); errors.Is(err, os.ErrNotExist) {
-			if err := os.Mkdir("/var/log/awx-relay", 0775); err != nil {
-				return fmt.Errorf("PrintStatus(): os.Mkdir(): %w", err)
-			}
-		} else if err != nil {
-			return fmt.Errorf("PrintStatus()): os.Stat(): %w", err)
-		}
-
-		// if the file doesn't exist, create it and write to it, otherwise append to it
-		f, err := os.OpenFile(logfile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-		if err != nil {
-			return fmt.Errorf("PrintStatus(): os.Open(): %w", err)
-		}
-		var writeErr error
-		fileData, err := os.ReadFile(logfile)
-		if err != nil {
-			return fmt.Errorf("PrintStatus(): os.Readfile(): %w", err)
-		}
-		if !strings.Contains(string(fileData), "Build Date") {
-			_, writeErr = f.WriteString(fmt.Sprintf("Build Date: %v\n", GetTime("full")))
-			if writeErr != nil {
-				f.Close() // ignore error; Write error takes precedence
-				return fmt.Errorf("PrintStatus(): f.WriteString(): %w", err)
-			}
-		}
-		if strings.Contains(msg, "\n") {
-			_, writeErr = f.WriteString(msg)
-		} else {
-			_, writeErr = f.WriteString(msg + "\n")
-		}
-		if writeErr != nil {
-			f.Close() // ignore error; Write error takes precedence
-			return fmt.Errorf("PrintStatus(): f.WriteString(): %w", err)
-		}
-		if err := f.Close(); err != nil {
-			return fmt.Errorf(fmt.Sprintf("PrintStatus(): f.Close(): %v", err))
-		}
-		// print to STDOUT, which is the systemd journal for awx-relay.service
-		// when started as a service, otherwise it's the terminal
-	} else {
-		fmt.Printf("%v\n", msg)
-	}
-
-	return nil
-}
-
 func ReadFile(path string) (map[string]string, error) {
 	vars := make(map[string]string)
 
@@ -358,43 +516,62 @@ func ReadFile(path string) (map[string]string, error) {
 		return vars, fmt.Errorf("ReadFile(): os.ReadFile(): %v", err)
 	}
 
-	// grab all the data matching a "WORD=ANYTEXT" pattern
-	r := regexp.MustCompile(`(?m).+=.+`)
-	po := r.FindAllStringSubmatch(string(data), -1)
+	return ParseVars(string(data)), nil
+}
+
+// ParseVars parses the key=value lines of the files written by Foreman, keys are lowercased. Values
+// are everything after the first =, so they can contain = themselves, ex. base64 encoded secrets.
+// Comments, and lines without a key or a value, are skipped
+func ParseVars(data string) map[string]string {
+	vars := make(map[string]string)
 
-	// take each regex result (which is a line of text from the file), split it at = then discard the =
-	// and store the split text into the map, with the left side being the key, right side being the value
-	for _, value := range po {
-		ss := strings.Split(value[0], "=")
+	for _, line := range strings.Split(data, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+
+		ss := strings.SplitN(strings.TrimSuffix(line, "\r"), "=", 2)
+		if len(ss) != 2 || ss[0] == "" || ss[1] == "" {
+			continue
+		}
 		vars[strings.ToLower(ss[0])] = ss[1]
 	}
 
-	return vars, nil
+	return vars
 }
 
-// AwxClientSetup sets up our modified client instance which can be re-used
-func AwxClientSetup() (*awxGo.AWX, error) {
-	// grab our AWX credentials which were written by Foreman
-	data, err := ReadFile("/var/tmp/.tower_creds")
+// AwxClientSetup sets up our modified client instance which can be re-used, its calls to AWX are abandoned once ctx is done
+func AwxClientSetup(ctx context.Context, config AwxConfig) (*AwxClient, error) {
+	// grab our AWX credentials, by default from the file written by Foreman
+	provider := config.Credentials
+	if provider == nil {
+		provider = &FileCredentials{Path: defaultCredentialsFile}
+	}
+	creds, err := provider.Credentials()
 	if err != nil {
 		return nil, fmt.Errorf("awxClientSetup(): %w", err)
 	}
+	username, password, token := creds.Username, creds.Password, creds.Token
 
-	var username, password string
-	for key, value := range data {
-		if key == "user" {
-			username = value
-		} else if key == "pass" {
-			password = value
-		}
+	// verifies the certificate of AWX against the configured CA bundle, unless insecure was asked for
+	client, err := config.HTTPClient()
+	if err != nil {
+		return nil, fmt.Errorf("awxClientSetup(): %w", err)
 	}
 
-	// disable SSL verification because it complains about an invalid cert
-	transport := &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
-	client := &http.Client{Transport: transport}
-
 	// create our AWX object, using the modified client we created above
-	awx := awxGo.NewAWX("https://awx.internaldomain.co", username, password, client)
-
-	return awx, nil
+	switch {
+	case token != "":
+		// a personal access token created ahead of time, it's up to whoever created it to revoke it
+		return NewAwxTokenClient(ctx, config.URL, token, client), nil
+	case config.OAuthClientID != "":
+		// a token that only lives as long as the build, it's revoked by CleanUp()
+		awx, err := CreateOAuthToken(ctx, config, client, username, password)
+		if err != nil {
+			return nil, fmt.Errorf("awxClientSetup(): %w", err)
+		}
+		return awx, nil
+	default:
+		return NewAwxClient(ctx, config.URL, username, password, client), nil
+	}
 }
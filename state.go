@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the status of a step while its AWX job is still running
+const StepRunning = "running"
+
+// the status of a step waiting to be relaunched after its AWX job failed, see RetryPolicy
+const StepRetrying = "retrying"
+
+// StepState is what's known about a single step of a build
+type StepState struct {
+	Name     string    `json:"name"`
+	JobID    int       `json:"jobid"`
+	Status   string    `json:"status"`
+	Attempts int       `json:"attempts"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+}
+
+// BuildState is persisted after every change so a build can pick up where it left off
+// after a reboot or a crash, instead of launching the same AWX jobs a second time
+type BuildState struct {
+	FQDN    string      `json:"fqdn"`
+	BuildID string      `json:"buildid"` // the ID of the build on the relay
+	Phase   string      `json:"phase"`
+	Result  string      `json:"result"`
+	JobVars JobVars     `json:"jobvars"`
+	Steps   []StepState `json:"steps"`
+	Created time.Time   `json:"created"`
+	Updated time.Time   `json:"updated"`
+
+	mu   sync.Mutex
+	path string
+}
+
+// StateFile returns the path of the state file of an FQDN
+func StateFile(dir, fqdn string) (string, error) {
+	if err := ValidateFQDN(fqdn); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, fqdn+".json"), nil
+}
+
+// LoadBuildState reads the state of the build of an FQDN. A build that never started, or
+// that was successful, gets a fresh state. A build that failed keeps its steps so the ones
+// that completed aren't launched again and a job that was still running is reattached to
+func LoadBuildState(dir, fqdn string) (*BuildState, error) {
+	path, err := StateFile(dir, fqdn)
+	if err != nil {
+		return nil, err
+	}
+	state := &BuildState{FQDN: fqdn, path: path}
+
+	data, err := os.ReadFile(state.path)
+	if errors.Is(err, os.ErrNotExist) {
+		state.Created = time.Now()
+		return state, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("LoadBuildState(): os.ReadFile(): %w", err)
+	}
+
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("LoadBuildState(): json.Unmarshal(): %v: %w", state.path, err)
+	}
+
+	if state.Phase == PhaseFinished {
+		if state.Result == ResultSuccessful {
+			return &BuildState{FQDN: fqdn, path: state.path, Created: time.Now()}, nil
+		}
+		// the build on the relay is over, the next attempt gets a new one
+		state.Phase = ""
+		state.Result = ""
+		state.BuildID = ""
+	}
+
+	return state, nil
+}
+
+// ListBuildStates returns the state of every build in dir which was interrupted before it finished
+func ListBuildStates(dir string) ([]*BuildState, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("ListBuildStates(): filepath.Glob(): %w", err)
+	}
+
+	var states []*BuildState
+	for _, file := range files {
+		fqdn := strings.TrimSuffix(filepath.Base(file), ".json")
+		if ValidateFQDN(fqdn) != nil {
+			continue // not the state of a build
+		}
+		state, err := LoadBuildState(dir, fqdn)
+		if err != nil {
+			return nil, fmt.Errorf("ListBuildStates(): %w", err)
+		}
+		if state.Phase != "" {
+			states = append(states, state)
+		}
+	}
+
+	return states, nil
+}
+
+// ResetBuildState removes the state of the build of an FQDN so the next build starts from scratch
+func ResetBuildState(dir, fqdn string) error {
+	path, err := StateFile(dir, fqdn)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("ResetBuildState(): os.Remove(): %w", err)
+	}
+	return nil
+}
+
+// the methods below are safe to call on a nil *BuildState, in which case nothing is persisted
+
+// Save writes the state to disk, replacing the old file in one go so a crash can't leave half of it behind
+func (s *BuildState) Save() error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.save()
+}
+
+func (s *BuildState) save() error {
+	s.Updated = time.Now()
+
+	data, err := json.MarshalIndent(s, "", " ")
+	if err != nil {
+		return fmt.Errorf("BuildState.Save(): json.MarshalIndent(): %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return fmt.Errorf("BuildState.Save(): os.MkdirAll(): %w", err)
+	}
+
+	tmpFile := s.path + ".tmp"
+	if err := os.WriteFile(tmpFile, data, 0644); err != nil {
+		return fmt.Errorf("BuildState.Save(): os.WriteFile(): %w", err)
+	}
+	if err := os.Rename(tmpFile, s.path); err != nil {
+		return fmt.Errorf("BuildState.Save(): os.Rename(): %w", err)
+	}
+
+	return nil
+}
+
+// update changes the state and saves it
+func (s *BuildState) update(change func()) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	change()
+	return s.save()
+}
+
+// SetPhase records the phase the build is in
+func (s *BuildState) SetPhase(phase string) error {
+	return s.update(func() { s.Phase = phase })
+}
+
+// RelayBuildID returns the ID of the build on the relay, if the host already sent one
+func (s *BuildState) RelayBuildID() string {
+	if s == nil {
+		return ""
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.BuildID
+}
+
+// SetBuildID records the ID of the build on the relay
+func (s *BuildState) SetBuildID(buildID string) error {
+	return s.update(func() { s.BuildID = buildID })
+}
+
+// SetJobVars records what the build was started with, so the relay can resume it on its own
+func (s *BuildState) SetJobVars(jobVars JobVars) error {
+	return s.update(func() { s.JobVars = jobVars })
+}
+
+// Finish records the final result of the build
+func (s *BuildState) Finish(result string) error {
+	return s.update(func() {
+		s.Phase = PhaseFinished
+		s.Result = result
+	})
+}
+
+// Step returns a copy of what's known about a step
+func (s *BuildState) Step(name string) StepState {
+	if s == nil {
+		return StepState{Name: name}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return *s.step(name)
+}
+
+func (s *BuildState) step(name string) *StepState {
+	for i := range s.Steps {
+		if s.Steps[i].Name == name {
+			return &s.Steps[i]
+		}
+	}
+	s.Steps = append(s.Steps, StepState{Name: name})
+	return &s.Steps[len(s.Steps)-1]
+}
+
+// StepLaunched records the AWX job launched for a step, attempt counts the launches of the step in this build
+func (s *BuildState) StepLaunched(name string, jobID, attempt int) error {
+	return s.update(func() {
+		step := s.step(name)
+		step.JobID = jobID
+		step.Status = StepRunning
+		step.Attempts = attempt
+		step.Started = time.Now()
+		step.Finished = time.Time{}
+	})
+}
+
+// StepFinished records the outcome of the AWX job of a step
+func (s *BuildState) StepFinished(name, status string) error {
+	return s.update(func() {
+		step := s.step(name)
+		step.Status = status
+		step.Finished = time.Now()
+	})
+}
+
+// ResumeStep checks the state for a step before it's launched. It returns the ID of
+// the AWX job to reattach to, if the job is still running or is waiting to be relaunched,
+// and whether the step already completed successfully, in which case it shouldn't run again
+func ResumeStep(bc *BuildContext, name string) (int, bool) {
+	step := bc.State.Step(name)
+
+	switch step.Status {
+	case StepSuccessful:
+		bc.PrintStatus(fmt.Sprintf("INFO: %v already completed successfully in job id %v, not launching it again", name, step.JobID))
+		return step.JobID, true
+	case StepRunning:
+		if step.JobID != 0 {
+			bc.PrintStatus(fmt.Sprintf("INFO: %v was already launched as job id %v, waiting for it to finish", name, step.JobID))
+			return step.JobID, false
+		}
+	case StepRetrying:
+		if step.JobID != 0 {
+			bc.PrintStatus(fmt.Sprintf("INFO: %v failed on attempt %v in job id %v, relaunching it", name, step.Attempts, step.JobID))
+			return step.JobID, false
+		}
+	}
+
+	return 0, false
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// RunStatus summarizes a run of awxclient foreman, it's printed as the last line of the
+// output and written to the status file so Foreman templates and monitoring can read it
+type RunStatus struct {
+	FQDN     string       `json:"fqdn"`
+	Type     string       `json:"type"`
+	Result   string       `json:"result"`
+	ExitCode int          `json:"exitcode"`
+	Code     string       `json:"code,omitempty"` // same codes as the errors of the relay
+	Message  string       `json:"message,omitempty"`
+	BuildID  string       `json:"buildid,omitempty"` // only set when the relay ran the build
+	Steps    []StepResult `json:"steps,omitempty"`
+	Started  time.Time    `json:"started"`
+	Finished time.Time    `json:"finished"`
+	Duration string       `json:"duration"`
+}
+
+// NewRunStatus starts the summary of a run
+func NewRunStatus() *RunStatus {
+	return &RunStatus{Started: time.Now()}
+}
+
+// the methods below are safe to call on a nil *RunStatus, the relay doesn't keep one
+
+// SetSteps records the outcome of every step
+func (r *RunStatus) SetSteps(steps []StepResult) {
+	if r == nil {
+		return
+	}
+	r.Steps = append([]StepResult(nil), steps...)
+}
+
+// SetBuildID records the ID of the build on the relay
+func (r *RunStatus) SetBuildID(buildID string) {
+	if r == nil {
+		return
+	}
+	r.BuildID = buildID
+}
+
+// Finish records how the run ended, successful, failed, cancelled or error. err is nil when it was successful
+func (r *RunStatus) Finish(err error) {
+	if r == nil {
+		return
+	}
+
+	r.Finished = time.Now()
+	r.Duration = r.Finished.Sub(r.Started).Round(time.Second).String()
+	r.ExitCode = ExitCode(err)
+
+	switch {
+	case err == nil:
+		r.Result = ResultSuccessful
+	case errors.Is(err, ErrJobFailed):
+		r.Result = ResultFailed
+	case errors.Is(err, ErrCancelled):
+		r.Result = ResultCancelled
+	default:
+		r.Result = ResultError
+	}
+
+	if err != nil {
+		r.Code = ErrorCode(err)
+		r.Message = err.Error()
+	}
+}
+
+// Line returns the summary as a single line of JSON prefixed with STATUS:
+func (r *RunStatus) Line() string {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Sprintf("STATUS: {\"result\":%q,\"exitcode\":%v}", r.Result, r.ExitCode)
+	}
+	return fmt.Sprintf("STATUS: %s", data)
+}
+
+// Write saves the summary to path, replacing the summary of the previous run
+func (r *RunStatus) Write(path string) error {
+	data, err := json.MarshalIndent(r, "", " ")
+	if err != nil {
+		return fmt.Errorf("RunStatus.Write(): json.MarshalIndent(): %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("RunStatus.Write(): os.MkdirAll(): %w", err)
+	}
+
+	tmpFile := path + ".tmp"
+	if err := os.WriteFile(tmpFile, data, 0644); err != nil {
+		return fmt.Errorf("RunStatus.Write(): os.WriteFile(): %w", err)
+	}
+	if err := os.Rename(tmpFile, path); err != nil {
+		return fmt.Errorf("RunStatus.Write(): os.Rename(): %w", err)
+	}
+
+	return nil
+}
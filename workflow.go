@@ -0,0 +1,211 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// WorkflowJob is the part of an AWX workflow job we care about
+type WorkflowJob struct {
+	ID     int    `json:"id"`
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Failed bool   `json:"failed"`
+}
+
+// WorkflowLaunch is the response of launching an AWX workflow job template
+type WorkflowLaunch struct {
+	ID          int `json:"id"`
+	WorkflowJob int `json:"workflow_job"`
+}
+
+// WorkflowNode is a single node of a running AWX workflow job
+type WorkflowNode struct {
+	ID            int `json:"id"`
+	SummaryFields struct {
+		Job *struct {
+			ID     int    `json:"id"`
+			Name   string `json:"name"`
+			Type   string `json:"type"`
+			Status string `json:"status"`
+			Failed bool   `json:"failed"`
+		} `json:"job"`
+		UnifiedJobTemplate *struct {
+			Name string `json:"name"`
+		} `json:"unified_job_template"`
+	} `json:"summary_fields"`
+}
+
+type workflowNodesResponse struct {
+	Results []WorkflowNode `json:"results"`
+}
+
+// ResolveWorkflowTemplate returns the ID of the AWX workflow job template called name
+func (bc *BuildContext) ResolveWorkflowTemplate(name string) (int, error) {
+	return awxNames.resolve("workflow job template", name, func() ([]namedObject, error) {
+		var response struct {
+			Results []namedObject `json:"results"`
+		}
+		if err := bc.AWX.GetJSON(bc.Context(), "/api/v2/workflow_job_templates/", map[string]string{"name": name}, &response); err != nil {
+			return nil, fmt.Errorf("ResolveWorkflowTemplate(): %w", err)
+		}
+		return response.Results, nil
+	})
+}
+
+// LaunchWorkflow kicks off an AWX workflow job template and returns the ID of the workflow job it launched
+func LaunchWorkflow(bc *BuildContext, step Step, params map[string]interface{}) (int, error) {
+	templateName := step.Name
+
+	// the state file knows whether this step already ran, or is still running in AWX
+	workflowJobID, done := ResumeStep(bc, templateName)
+	if done {
+		return workflowJobID, nil
+	}
+
+	bc.SetPhase(PhaseRunning, templateName)
+	if workflowJobID == 0 {
+		bc.PrintStatus(fmt.Sprintf("INFO: Kicking off workflow %v...", templateName))
+
+		var result WorkflowLaunch
+		endpoint := fmt.Sprintf("/api/v2/workflow_job_templates/%v/launch/", step.TemplateID)
+		launched := time.Now()
+		if err := bc.AWX.PostJSON(bc.Context(), endpoint, params, &result); err != nil {
+			return 0, launchInterrupted(bc, step, "workflow_jobs", params, launched, fmt.Errorf("LaunchWorkflow(): %w", err))
+		}
+		workflowJobID = result.WorkflowJob
+		bc.CheckState(bc.State.StepLaunched(templateName, workflowJobID, 1))
+	}
+	bc.SetJobID(workflowJobID)
+
+	// checks the status of the workflow and its nodes until it completes or errors out
+	status, jobErr := GetWorkflowStatus(bc, workflowJobID, step.Poll)
+	if jobErr != nil {
+		// workflow failure
+		if errors.Is(jobErr, ErrJobFailed) {
+			bc.CheckState(bc.State.StepFinished(templateName, StepFailed))
+			observeStep(bc, templateName)
+			return workflowJobID, jobErr
+		} else if errors.Is(jobErr, ErrCancelled) {
+			// the workflow is only still running if it's the build that was cancelled, not the workflow
+			if bc.Cancelled() != nil {
+				CancelJob(bc, "workflow_jobs", workflowJobID)
+			}
+			bc.CheckState(bc.State.StepFinished(templateName, StepCancelled))
+			observeStep(bc, templateName)
+			return workflowJobID, jobErr
+		} else {
+			// software issue, the workflow may well still be running so leave it to be reattached to
+			return workflowJobID, Wrap("launchWorkflow()", jobErr)
+		}
+	}
+
+	bc.PrintStatus(fmt.Sprintf("INFO: Status of %v: %v", templateName, status))
+	bc.CheckState(bc.State.StepFinished(templateName, StepSuccessful))
+	observeStep(bc, templateName)
+
+	return workflowJobID, nil
+}
+
+// GetWorkflowStatus follows a workflow job and its nodes until it's no longer pending or running.
+// A workflow that didn't succeed returns an error naming the node that failed. How often it's
+// checked and for how long is set by the poll policy of the step
+func GetWorkflowStatus(bc *BuildContext, workflowJobID int, poll PollPolicy) (string, error) {
+	reported := make(map[int]string)        // last status logged for each node
+	events := make(map[int]*JobEventStream) // output of the job run by each node
+
+	poller := newJobPoller(bc, fmt.Sprintf("workflow job id %v", workflowJobID), poll)
+	if err := poller.Start(); err != nil {
+		return "", err
+	}
+
+	for {
+		var job WorkflowJob
+		var nodes []WorkflowNode
+		err := bc.AWX.GetJSON(bc.Context(), fmt.Sprintf("/api/v2/workflow_jobs/%v/", workflowJobID), nil, &job)
+		if err == nil {
+			nodes, err = getWorkflowNodes(bc, workflowJobID)
+		}
+		if err != nil {
+			if err := poller.Failed(fmt.Errorf("GetWorkflowStatus(): %w", err)); err != nil {
+				return "", err
+			}
+			if err := poller.Next(); err != nil {
+				return "", err
+			}
+			continue
+		}
+		poller.Seen(job.Status)
+
+		// log each node as it changes state so the build log follows the workflow
+		for _, node := range nodes {
+			if node.SummaryFields.Job == nil {
+				continue
+			}
+
+			// only playbook runs have events, nodes can also run project or inventory updates
+			if node.SummaryFields.Job.Type == "job" {
+				if events[node.ID] == nil {
+					events[node.ID] = NewJobEventStream(bc, node.SummaryFields.Job.ID)
+				}
+				if err := events[node.ID].Poll(); err != nil {
+					bc.PrintStatus(fmt.Sprintf("INFO: Couldn't fetch the output of job id %v: %v", node.SummaryFields.Job.ID, err))
+				}
+			}
+
+			if reported[node.ID] == node.SummaryFields.Job.Status {
+				continue
+			}
+			reported[node.ID] = node.SummaryFields.Job.Status
+			bc.PrintStatus(fmt.Sprintf("INFO: Workflow node %v: %v (job id %v)",
+				nodeName(node), node.SummaryFields.Job.Status, node.SummaryFields.Job.ID))
+		}
+
+		switch job.Status {
+		case "new", "pending", "waiting", "running":
+		case "successful":
+			return job.Status, nil
+		case "canceled":
+			// same as a job step that was cancelled in AWX
+			return job.Status, NewError(ErrCancelled, "%v (workflow job id %v) was cancelled in AWX", job.Name, workflowJobID)
+		default:
+			// failed or error, find out which node caused it
+			for _, node := range nodes {
+				if node.SummaryFields.Job != nil && (node.SummaryFields.Job.Failed || node.SummaryFields.Job.Status == "failed" ||
+					node.SummaryFields.Job.Status == "error" || node.SummaryFields.Job.Status == "canceled") {
+					if stream := events[node.ID]; stream != nil && stream.Failure() != "" {
+						return job.Status, NewError(ErrJobFailed, "%v failed at %v. Workflow node %v failed, %v. Check job id %v for more info",
+							job.Name, GetTime("short"), nodeName(node), stream.Failure(), node.SummaryFields.Job.ID)
+					}
+					return job.Status, NewError(ErrJobFailed, "%v failed at %v. Workflow node %v failed, check job id %v for more info",
+						job.Name, GetTime("short"), nodeName(node), node.SummaryFields.Job.ID)
+				}
+			}
+			return job.Status, NewError(ErrJobFailed, "%v failed at %v with status %v. Check workflow job id %v for more info",
+				job.Name, GetTime("short"), job.Status, workflowJobID)
+		}
+
+		// check again once the interval has passed
+		if err := poller.Next(); err != nil {
+			return job.Status, err
+		}
+	}
+}
+
+func getWorkflowNodes(bc *BuildContext, workflowJobID int) ([]WorkflowNode, error) {
+	var response workflowNodesResponse
+	endpoint := fmt.Sprintf("/api/v2/workflow_jobs/%v/workflow_nodes/", workflowJobID)
+	if err := bc.AWX.GetJSON(bc.Context(), endpoint, map[string]string{"page_size": "200"}, &response); err != nil {
+		return nil, fmt.Errorf("getWorkflowNodes(): %w", err)
+	}
+	return response.Results, nil
+}
+
+// nodeName returns the name of the template a workflow node runs
+func nodeName(node WorkflowNode) string {
+	if node.SummaryFields.UnifiedJobTemplate != nil {
+		return node.SummaryFields.UnifiedJobTemplate.Name
+	}
+	return fmt.Sprintf("%v", node.ID)
+}